@@ -7,7 +7,6 @@ import (
 	"net"
 	"os"
 
-	"github.com/sebzz2k2/vaultic/internal/protocol/lexer"
 	"github.com/sebzz2k2/vaultic/internal/resp"
 )
 
@@ -17,7 +16,7 @@ func main() {
 	flag.Parse()
 
 	// Establish TCP connection
-	address := fmt.Sprintf("%s:%s", *host, *port)
+	address := net.JoinHostPort(*host, *port)
 	fmt.Printf("Connecting to Vaultic at %s\n", address)
 
 	conn, err := net.Dial("tcp", address)
@@ -30,32 +29,71 @@ func main() {
 	fmt.Println("Successfully connected to Vaultic server!")
 	fmt.Println("Hello, Vaultic!")
 	scanner := bufio.NewScanner(os.Stdin)
+	decoder := resp.NewDecoder(conn)
 
 	for {
 		fmt.Print("vaultic> ")
 		if !scanner.Scan() {
 			break
 		}
-		tknStr := lexer.TokenizeCLI(scanner.Text())
+		args, err := resp.SplitArgs(scanner.Text())
+		if err != nil {
+			fmt.Printf("(error) %v\n", err)
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		tknStr := resp.NewBuilder(false).Array(args).Build()
 
 		// Send the tokenized string to the server
-		_, err := conn.Write([]byte(tknStr))
+		_, err = conn.Write([]byte(tknStr))
 		if err != nil {
 			fmt.Printf("Error sending data to server: %v\n", err)
 			continue
 		}
 
-		decodedResponse, err := resp.NewDecoder(bufio.NewReader(conn)).Decode()
+		decodedResponse, err := decoder.Decode()
 		if err != nil {
 			fmt.Printf("Error reading response from server: %v\n", err)
 			continue
 		}
-		for _, v := range decodedResponse.Array {
-			fmt.Println(v.String)
-		}
+		printReply(decodedResponse)
 	}
 
 	if err := scanner.Err(); err != nil {
 		fmt.Println("Error reading input:", err)
 	}
 }
+
+func printReply(v *resp.RESPValue) {
+	switch v.Type {
+	case resp.ERROR:
+		fmt.Println("(error) " + v.Error)
+	case resp.SIMPLE_STRING:
+		fmt.Println(v.String)
+	case resp.INTEGER:
+		fmt.Printf("(integer) %d\n", v.Int)
+	case resp.NULL:
+		fmt.Println("(nil)")
+	case resp.ARRAY, resp.SET, resp.PUSH:
+		if len(v.Array) == 0 {
+			fmt.Println("(empty array)")
+		}
+		for i, e := range v.Array {
+			fmt.Printf("%d) ", i+1)
+			printReply(&e)
+		}
+	case resp.MAP:
+		for k, e := range v.Map {
+			fmt.Printf("%s => ", k)
+			printReply(&e)
+		}
+	default:
+		if v.Null {
+			fmt.Println("(nil)")
+			return
+		}
+		fmt.Printf("%q\n", v.String)
+	}
+}
@@ -1,197 +1,545 @@
 package protocol
 
 import (
+	"errors"
 	"fmt"
-	"io"
-	"os"
-	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/sebzz2k2/vaultic/internal/index"
-	"github.com/sebzz2k2/vaultic/internal/protocol/lexer"
-	"github.com/sebzz2k2/vaultic/internal/wal"
+	"github.com/rs/zerolog/log"
 
+	"github.com/sebzz2k2/vaultic/internal/storage"
 	"github.com/sebzz2k2/vaultic/pkg/utils"
 )
 
+// Store is the storage the commands operate on.
+type Store interface {
+	Get(key string) (string, bool, error)
+	GetRange(key string, span func(size int) (from, to int)) (string, bool, error)
+	Set(key, value string) error
+	SetWithOptions(key, value string, opts storage.SetOptions) (storage.SetResult, error)
+	GetMany(keys []string) ([]string, []bool, error)
+	SetMany(pairs []storage.KeyValue, ifNoneExist bool) (bool, error)
+	Update(key string, fn func(value string, found bool) (string, error)) (string, error)
+	GetDel(key string) (string, bool, error)
+	GetEx(key string, opts storage.GetExOptions) (string, bool, error)
+	DeleteMany(keys []string) (int, error)
+	CountExisting(keys []string) (int, error)
+	Expire(key string, at time.Time) (bool, error)
+	Persist(key string) (bool, error)
+	ExpireTime(key string) (time.Time, bool, error)
+	KeysWithPrefix(prefix string, match func(key string) bool) ([]string, error)
+	KeyCount() (int, error)
+	Scan(start string, count int, match func(key string) bool) ([]string, string, error)
+	Info() map[string]string
+}
+
+// Protocol runs commands against a store. One Protocol serves every
+// connection, so that state such as SCAN cursors is shared between them.
 type Protocol struct {
-	idx *index.Index
-	wal *wal.WAL
+	store    Store
+	commands *Registry
+	cursors  *cursorTable
 }
 
-var processors = map[lexer.TokenKind]any{
-	lexer.CMD_GET:    (*Protocol).get,
-	lexer.CMD_SET:    (*Protocol).set,
-	lexer.CMD_DEL:    (*Protocol).del,
-	lexer.CMD_EXISTS: (*Protocol).exists,
-	lexer.CMD_KEYS:   (*Protocol).keys,
+// commandTable lists every command the server knows. Adding a command means
+// adding it here.
+var commandTable = []*Command{
+	{
+		Name: "get", Arity: 2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "string", Summary: "Returns the string value of a key.",
+		Handler: (*Protocol).get,
+	},
+	{
+		Name: "set", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "string", Summary: "Sets the string value of a key: SET key value [NX | XX] [GET] [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL].",
+		Handler: (*Protocol).set,
+	},
+	{
+		Name: "getdel", Arity: 2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "string", Summary: "Returns the string value of a key after deleting the key.",
+		Handler: (*Protocol).getdel,
+	},
+	{
+		Name: "getex", Arity: -2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "string", Summary: "Returns the string value of a key after setting its expiration time: GETEX key [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | PERSIST].",
+		Handler: (*Protocol).getex,
+	},
+	{
+		Name: "append", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "string", Summary: "Appends a string to the value of a key. Creates the key if it doesn't exist.",
+		Handler: (*Protocol).append,
+	},
+	{
+		Name: "strlen", Arity: 2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "string", Summary: "Returns the length of a string value.",
+		Handler: (*Protocol).strlen,
+	},
+	{
+		Name: "getrange", Arity: 4, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "string", Summary: "Returns a substring of the string stored at a key.",
+		Handler: (*Protocol).getrange,
+	},
+	{
+		Name: "setrange", Arity: 4, Flags: FlagWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "string", Summary: "Overwrites a part of a string value with another by an offset. Creates the key if it doesn't exist.",
+		Handler: (*Protocol).setrange,
+	},
+	{
+		Name: "mget", Arity: -2, Flags: FlagReadonly, FirstKey: 1, LastKey: -1, KeyStep: 1,
+		Group: "string", Summary: "Atomically returns the string values of one or more keys.",
+		Handler: (*Protocol).mget,
+	},
+	{
+		Name: "mset", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: -1, KeyStep: 2,
+		Group: "string", Summary: "Atomically creates or modifies the string values of one or more keys.",
+		Handler: (*Protocol).mset,
+	},
+	{
+		Name: "msetnx", Arity: -3, Flags: FlagWrite, FirstKey: 1, LastKey: -1, KeyStep: 2,
+		Group: "string", Summary: "Atomically modifies the string values of one or more keys only when all keys don't exist.",
+		Handler: (*Protocol).mset,
+	},
+	{
+		Name: "incr", Arity: 2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "string", Summary: "Increments the integer value of a key by one.",
+		Handler: (*Protocol).incr,
+	},
+	{
+		Name: "decr", Arity: 2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "string", Summary: "Decrements the integer value of a key by one.",
+		Handler: (*Protocol).incr,
+	},
+	{
+		Name: "incrby", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "string", Summary: "Increments the integer value of a key by a number.",
+		Handler: (*Protocol).incr,
+	},
+	{
+		Name: "decrby", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "string", Summary: "Decrements a number from the integer value of a key.",
+		Handler: (*Protocol).incr,
+	},
+	{
+		Name: "incrbyfloat", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "string", Summary: "Increments the floating point value of a key by a number.",
+		Handler: (*Protocol).incrByFloat,
+	},
+	{
+		Name: "del", Arity: -2, Flags: FlagWrite, FirstKey: 1, LastKey: -1, KeyStep: 1,
+		Group: "keyspace", Summary: "Deletes one or more keys.",
+		Handler: (*Protocol).del,
+	},
+	{
+		Name: "exists", Arity: -2, Flags: FlagReadonly, FirstKey: 1, LastKey: -1, KeyStep: 1,
+		Group: "keyspace", Summary: "Determines whether one or more keys exist.",
+		Handler: (*Protocol).exists,
+	},
+	{
+		Name: "expire", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "keyspace", Summary: "Sets the expiration time of a key in seconds.",
+		Handler: (*Protocol).expire,
+	},
+	{
+		Name: "pexpire", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "keyspace", Summary: "Sets the expiration time of a key in milliseconds.",
+		Handler: (*Protocol).expire,
+	},
+	{
+		Name: "expireat", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "keyspace", Summary: "Sets the expiration time of a key to a Unix timestamp in seconds.",
+		Handler: (*Protocol).expire,
+	},
+	{
+		Name: "pexpireat", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "keyspace", Summary: "Sets the expiration time of a key to a Unix timestamp in milliseconds.",
+		Handler: (*Protocol).expire,
+	},
+	{
+		Name: "ttl", Arity: 2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "keyspace", Summary: "Returns the expiration time in seconds of a key.",
+		Handler: (*Protocol).ttl,
+	},
+	{
+		Name: "pttl", Arity: 2, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "keyspace", Summary: "Returns the expiration time in milliseconds of a key.",
+		Handler: (*Protocol).ttl,
+	},
+	{
+		Name: "persist", Arity: 2, Flags: FlagWrite, FirstKey: 1, LastKey: 1, KeyStep: 1,
+		Group: "keyspace", Summary: "Removes the expiration time of a key.",
+		Handler: (*Protocol).persist,
+	},
+	{
+		Name: "keys", Arity: 2, Flags: FlagReadonly,
+		Group: "keyspace", Summary: "Returns all key names that match a pattern.",
+		Handler: (*Protocol).keys,
+	},
+	{
+		Name: "dbsize", Arity: 1, Flags: FlagReadonly,
+		Group: "server", Summary: "Returns the number of keys in the database.",
+		Handler: (*Protocol).dbsize,
+	},
+	{
+		Name: "scan", Arity: -2, Flags: FlagReadonly,
+		Group: "keyspace", Summary: "Iterates over the key names: SCAN cursor [MATCH pattern] [COUNT count] [TYPE type].",
+		Handler: (*Protocol).scan,
+	},
+	{
+		Name: "info", Arity: -1, Flags: FlagAdmin,
+		Group: "server", Summary: "Returns information and statistics about the server: INFO [section ...].",
+		Handler: (*Protocol).info,
+	},
+	{
+		Name: "hello", Arity: -1,
+		Group: "connection", Summary: "Switches the protocol version and describes the server.",
+		Handler: (*Protocol).hello,
+	},
+	{
+		Name: "command", Arity: -1,
+		Group: "server", Summary: "Returns details about commands: COMMAND [COUNT | INFO [name ...] | DOCS [name ...]].",
+		Handler: (*Protocol).command,
+	},
 }
 
-func validateArgsAndCount(t []lexer.Token) (bool, error) {
-	if len(t) == 0 {
-		return false, fmt.Errorf("No enough tokens provided")
+// commands is the registry of commandTable, shared by every Protocol.
+var commands = NewRegistry(commandTable...)
+
+func NewProtocol(store Store) *Protocol {
+	return &Protocol{
+		store:    store,
+		commands: commands,
+		cursors:  newCursorTable(),
 	}
-	if utils.CmdArgs[strings.ToUpper(t[0].Value)] != len(t)-1 {
-		return false, fmt.Errorf("Wrong argument count for command: %s", t[0].Value)
+}
+
+// ProcessCommand runs the command in args, whose first element names it,
+// for the client of session and returns its reply. Failures are returned as
+// Error replies.
+func (p *Protocol) ProcessCommand(session *Session, args []string) Reply {
+	if len(args) == 0 {
+		return Error("ERR empty command")
 	}
-	for _, tok := range t[1:] {
-		if tok.Kind != lexer.VALUE {
-			return false, fmt.Errorf("Invalid token: %s", tok.Value)
-		}
+
+	cmd, ok := p.commands.Lookup(args[0])
+	if !ok {
+		return Error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
 	}
-	return true, nil
-}
+	if !cmd.checkArity(len(args)) {
+		return Error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", cmd.Name))
+	}
+	log.Trace().Str("command", cmd.Name).Int("args", len(args)-1).Msg("Processing command")
 
-func NewProtocol(wal *wal.WAL) *Protocol {
-	return &Protocol{
-		//TODO remove hardcoded index file name
-		idx: index.NewIndex("vaultic", wal),
-		wal: wal,
+	reply, err := cmd.Handler(p, &Request{Session: session, Command: cmd, Args: args[1:]})
+	if err != nil {
+		return Error("ERR " + err.Error())
 	}
+	return reply
 }
 
-func (p *Protocol) ProcessCommand(tokens []lexer.Token) (string, error) {
-	fmt.Println("Processing command:", tokens)
-	if len(tokens) == 0 {
-		return "", fmt.Errorf("No enough tokens provided")
+func (p *Protocol) get(req *Request) (Reply, error) {
+	val, found, err := p.store.Get(req.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return Null{}, nil
 	}
+	return BulkString(val), nil
+}
 
-	cmd := tokens[0]
+var (
+	errSyntax     = errors.New("syntax error")
+	errNotInteger = errors.New("value is not an integer or out of range")
+)
 
-	if _, ok := processors[cmd.Kind]; !ok {
-		return "", fmt.Errorf("Invalid command: %s", cmd.Value)
+// set writes a value, qualified by the options parseSetOptions accepts. It
+// replies OK, or a null when an NX or XX condition fails. With GET it
+// replies the old value instead, or a null if there was none.
+func (p *Protocol) set(req *Request) (Reply, error) {
+	key, value := req.Args[0], req.Args[1]
+	if len(req.Args) == 2 {
+		if err := p.store.Set(key, value); err != nil {
+			return nil, err
+		}
+		return SimpleString("OK"), nil
 	}
 
-	isValidArgCount, err := validateArgsAndCount(tokens)
+	opts, get, err := parseSetOptions(req.Args[2:], time.Now())
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	if !isValidArgCount {
-		return "", fmt.Errorf("Wrong argument count for command: %s", cmd.Value)
+	result, err := p.store.SetWithOptions(key, value, opts)
+	if err != nil {
+		return nil, err
 	}
-
-	fn, ok := processors[cmd.Kind]
-	if !ok {
-		return "", fmt.Errorf("Unknown command: %s", cmd.Value)
+	switch {
+	case get && !result.Existed:
+		return Null{}, nil
+	case get:
+		return BulkString(result.Old), nil
+	case !result.Written:
+		return Null{}, nil
+	default:
+		return SimpleString("OK"), nil
 	}
+}
 
-	fnValue := reflect.ValueOf(fn)
+// parseSetOptions parses the options of SET that follow the key and value:
+// NX or XX, GET, and at most one of EX, PX, EXAT, PXAT and KEEPTTL. It
+// reports whether GET was given separately, as it does not affect the write.
+func parseSetOptions(args []string, now time.Time) (storage.SetOptions, bool, error) {
+	var opts storage.SetOptions
+	get, expires := false, false
+	for i := 0; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i]); option {
+		case "NX":
+			if opts.IfPresent {
+				return opts, false, errSyntax
+			}
+			opts.IfAbsent = true
+		case "XX":
+			if opts.IfAbsent {
+				return opts, false, errSyntax
+			}
+			opts.IfPresent = true
+		case "GET":
+			get = true
+		case "KEEPTTL":
+			if expires {
+				return opts, false, errSyntax
+			}
+			expires, opts.KeepTTL = true, true
+		case "EX", "PX", "EXAT", "PXAT":
+			if expires || i+1 == len(args) {
+				return opts, false, errSyntax
+			}
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				return opts, false, errNotInteger
+			}
+			if n <= 0 {
+				return opts, false, errInvalidExpireTime("set")
+			}
+			at, err := expireTime(option, n, now, "set")
+			if err != nil {
+				return opts, false, err
+			}
+			expires, opts.ExpireAt = true, at
+		default:
+			return opts, false, errSyntax
+		}
+	}
+	return opts, get, nil
+}
 
-	args := tokens[1:]
-	reflectArgs := make([]reflect.Value, len(args)+1)
-	reflectArgs[0] = reflect.ValueOf(p)
-	for i, tok := range args {
-		reflectArgs[i+1] = reflect.ValueOf(tok.Value)
+// mget replies the values of the keys, with a null for each key that does
+// not exist.
+func (p *Protocol) mget(req *Request) (Reply, error) {
+	values, found, err := p.store.GetMany(req.Args)
+	if err != nil {
+		return nil, err
+	}
+	reply := make(Array, len(values))
+	for i, value := range values {
+		if found[i] {
+			reply[i] = BulkString(value)
+		} else {
+			reply[i] = Null{}
+		}
 	}
+	return reply, nil
+}
 
-	results := fnValue.Call(reflectArgs)
+// mset writes key value pairs, all of them or none. MSET replies OK. MSETNX
+// only writes if none of the keys exists and replies 1 if it did, 0 if not.
+func (p *Protocol) mset(req *Request) (Reply, error) {
+	if len(req.Args)%2 != 0 {
+		return nil, fmt.Errorf("wrong number of arguments for '%s' command", req.Command.Name)
+	}
+	pairs := make([]storage.KeyValue, 0, len(req.Args)/2)
+	for i := 0; i < len(req.Args); i += 2 {
+		pairs = append(pairs, storage.KeyValue{Key: req.Args[i], Value: req.Args[i+1]})
+	}
 
-	if len(results) != 2 {
-		return "", fmt.Errorf("Unexpected return values")
+	nx := req.Command.Name == "msetnx"
+	written, err := p.store.SetMany(pairs, nx)
+	switch {
+	case err != nil:
+		return nil, err
+	case !nx:
+		return SimpleString("OK"), nil
+	case written:
+		return Integer(1), nil
+	default:
+		return Integer(0), nil
 	}
+}
 
-	strResult, ok := results[0].Interface().(string)
-	if !ok {
-		return "", fmt.Errorf("First return value is not a string")
+// del deletes the keys and replies how many of them existed.
+func (p *Protocol) del(req *Request) (Reply, error) {
+	n, err := p.store.DeleteMany(req.Args)
+	if err != nil {
+		return nil, err
 	}
+	return Integer(n), nil
+}
 
-	if !results[1].IsNil() {
-		err = results[1].Interface().(error)
+// exists replies how many of the keys exist, counting a key as often as it
+// is given.
+func (p *Protocol) exists(req *Request) (Reply, error) {
+	n, err := p.store.CountExisting(req.Args)
+	if err != nil {
+		return nil, err
 	}
+	return Integer(n), nil
+}
 
-	return strResult, err
+// keys returns the keys matching a glob pattern. Only the keys starting with
+// the literal prefix of the pattern are read.
+func (p *Protocol) keys(req *Request) (Reply, error) {
+	pattern := req.Args[0]
+	prefix := globPrefix(pattern)
+	var match func(key string) bool
+	if pattern != prefix+"*" {
+		match = func(key string) bool { return globMatch(pattern, key) }
+	}
+	keys, err := p.store.KeysWithPrefix(prefix, match)
+	if err != nil {
+		return nil, err
+	}
+	reply := make(Array, len(keys))
+	for i, key := range keys {
+		reply[i] = BulkString(key)
+	}
+	return reply, nil
 }
 
-func (p *Protocol) get(key string) (string, error) {
-	file, err := os.Open(utils.FILENAME)
+func (p *Protocol) dbsize(req *Request) (Reply, error) {
+	n, err := p.store.KeyCount()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return "(nil)", nil
-		}
-		return "", fmt.Errorf("Failed to open WAL file")
+		return nil, err
 	}
-	defer file.Close()
-	start, end, found := p.idx.Get(key)
-	if found {
-		_, err := file.Seek(int64(start), io.SeekStart)
+	return Integer(n), nil
+}
+
+// hello switches the connection to the requested protocol version, if any,
+// and describes the server. The only option supported is SETNAME.
+func (p *Protocol) hello(req *Request) (Reply, error) {
+	s, args := req.Session, req.Args
+	proto := s.Proto
+	if len(args) > 0 {
+		v, err := strconv.Atoi(args[0])
 		if err != nil {
-			return "", fmt.Errorf("Failed to seek in WAL file")
+			return nil, errors.New("Protocol version is not an integer or out of range")
 		}
-		b := make([]byte, end-start)
-		n, err := file.Read(b)
-		if err != nil {
-			return "", fmt.Errorf("Failed to read from WAL file")
+		if v != RESP2 && v != RESP3 {
+			return Error("NOPROTO unsupported protocol version"), nil
 		}
-		return string(b[:n]), nil
+		proto = v
+		args = args[1:]
 	}
-	return "(nil)", nil
-}
 
-func (p *Protocol) set(key, val string) (string, error) {
-	now := time.Now()
-	epochSeconds := now.Unix()
+	name := s.Name
+	for len(args) > 0 {
+		if strings.ToUpper(args[0]) != "SETNAME" || len(args) < 2 {
+			return nil, fmt.Errorf("syntax error in HELLO option '%s'", args[0])
+		}
+		name = args[1]
+		args = args[2:]
+	}
+	s.Proto, s.Name = proto, name
 
-	setVal, totalLen := p.wal.EncodeWAL(1, false, uint64(epochSeconds), false, key, val)
+	return Map{
+		{"server", BulkString("vaultic")},
+		{"version", BulkString(utils.Version)},
+		{"proto", Integer(proto)},
+		{"mode", BulkString("standalone")},
+		{"role", BulkString("master")},
+		{"modules", Array{}},
+	}, nil
+}
 
-	file, err := os.OpenFile(utils.FILENAME, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return "", err
-	}
-	size, err := file.Seek(0, io.SeekEnd)
-	if err != nil {
-		return "", err
+// info replies the statistics of the store, one name:value line each. They
+// are not divided into sections, so section arguments such as INFO server
+// are accepted and every line is returned.
+func (p *Protocol) info(req *Request) (Reply, error) {
+	info := p.store.Info()
+	names := make([]string, 0, len(info))
+	for name := range info {
+		names = append(names, name)
 	}
-	offset := uint32(size) + uint32(totalLen)
-	start := offset - uint32(len(val))
-	p.idx.Set(key, start, offset)
-	defer file.Close()
-	_, err = file.Write(setVal)
-	if err != nil {
-		return "", err
+	sort.Strings(names)
+
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = name + ":" + info[name]
 	}
-	return "OK", nil
+	return BulkString(strings.Join(lines, "\r\n") + "\r\n"), nil
 }
 
-func (p *Protocol) del(key string) (string, error) {
-	_, _, found := p.idx.Get(key)
-	if !found {
-		return "(nil)", nil
+// command describes the command table: COMMAND and COMMAND INFO without
+// names list every command, COMMAND COUNT counts them, and COMMAND INFO or
+// COMMAND DOCS with names describe just those.
+func (p *Protocol) command(req *Request) (Reply, error) {
+	if len(req.Args) == 0 {
+		return p.commandInfo(nil), nil
 	}
-	now := time.Now()
-	epochSeconds := now.Unix()
 
-	setVal, _ := p.wal.EncodeWAL(1, true, uint64(epochSeconds), false, key, "(nil)")
-	file, err := os.OpenFile(utils.FILENAME, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return "", fmt.Errorf("Failed to open WAL file")
+	sub, names := strings.ToLower(req.Args[0]), req.Args[1:]
+	switch sub {
+	case "count":
+		if len(names) > 0 {
+			return nil, fmt.Errorf("wrong number of arguments for 'command|%s' command", sub)
+		}
+		return Integer(len(p.commands.Commands())), nil
+	case "info":
+		return p.commandInfo(names), nil
+	case "docs":
+		return p.commandDocs(names), nil
+	default:
+		return nil, fmt.Errorf("unknown subcommand '%s'. Try COMMAND INFO or COMMAND DOCS.", req.Args[0])
 	}
+}
 
-	_, err = file.Seek(0, io.SeekEnd)
-	if err != nil {
-		return "", fmt.Errorf("Failed to seek in WAL file")
+// commandInfo describes the named commands, with a null for every unknown
+// name, or all commands if names is empty.
+func (p *Protocol) commandInfo(names []string) Reply {
+	var reply Array
+	if len(names) == 0 {
+		for _, c := range p.commands.Commands() {
+			reply = append(reply, c.infoReply())
+		}
+		return reply
 	}
-	defer file.Close()
-	_, err = file.Write(setVal)
-	if err != nil {
-		return "", fmt.Errorf("Failed to write to WAL file")
+	for _, name := range names {
+		if c, ok := p.commands.Lookup(name); ok {
+			reply = append(reply, c.infoReply())
+		} else {
+			reply = append(reply, Null{})
+		}
 	}
-	p.idx.Del(key)
-	return "OK", nil
+	return reply
 }
 
-func (p *Protocol) exists(key string) (string, error) {
-	_, _, found := p.idx.Get(key)
-	if found {
-		return "true", nil
+// commandDocs documents the named commands, skipping unknown names, or all
+// commands if names is empty.
+func (p *Protocol) commandDocs(names []string) Reply {
+	commands := p.commands.Commands()
+	if len(names) > 0 {
+		commands = nil
+		for _, name := range names {
+			if c, ok := p.commands.Lookup(name); ok {
+				commands = append(commands, c)
+			}
+		}
 	}
-	return "false", nil
-}
-
-func (p *Protocol) keys() (string, error) {
-	keys := p.idx.Keys()
-	if len(keys) == 0 {
-		return "(nil)", nil
+	reply := Map{}
+	for _, c := range commands {
+		reply = append(reply, MapEntry{c.Name, c.docsReply()})
 	}
-	return strings.Join(keys, ", "), nil
+	return reply
 }
@@ -0,0 +1,115 @@
+package protocol
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	errOverflow      = errors.New("increment or decrement would overflow")
+	errNotFloat      = errors.New("value is not a valid float")
+	errNaNOrInfinity = errors.New("increment would produce NaN or Infinity")
+)
+
+// incr adds to the integer value of a key: 1 with INCR, -1 with DECR, and
+// the argument with INCRBY or its negation with DECRBY. A missing key counts
+// as 0. It replies the new value. The value must be a 64-bit integer, and so
+// must the result.
+func (p *Protocol) incr(req *Request) (Reply, error) {
+	delta := int64(1)
+	if len(req.Args) == 2 {
+		n, err := parseInt(req.Args[1])
+		if err != nil {
+			return nil, err
+		}
+		delta = n
+	}
+	if req.Command.Name == "decr" || req.Command.Name == "decrby" {
+		if delta == math.MinInt64 {
+			return nil, errOverflow
+		}
+		delta = -delta
+	}
+
+	var result int64
+	_, err := p.store.Update(req.Args[0], func(value string, found bool) (string, error) {
+		var n int64
+		if found {
+			var err error
+			if n, err = parseInt(value); err != nil {
+				return "", err
+			}
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return "", errOverflow
+		}
+		result = n + delta
+		return strconv.FormatInt(result, 10), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return Integer(result), nil
+}
+
+// incrByFloat adds a floating point number to the value of a key, a missing
+// key counting as 0, and replies the new value. Neither the value nor the
+// result may be NaN or infinite.
+func (p *Protocol) incrByFloat(req *Request) (Reply, error) {
+	delta, err := parseFloat(req.Args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	var result float64
+	_, err = p.store.Update(req.Args[0], func(value string, found bool) (string, error) {
+		var n float64
+		if found {
+			var err error
+			if n, err = parseFloat(value); err != nil {
+				return "", err
+			}
+		}
+		result = n + delta
+		if math.IsNaN(result) || math.IsInf(result, 0) {
+			return "", errNaNOrInfinity
+		}
+		return formatFloat(result), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return Double(result), nil
+}
+
+// parseInt parses a 64-bit integer as strictly as Redis does: in decimal,
+// without a plus sign or leading zeros.
+func parseInt(s string) (int64, error) {
+	digits := strings.TrimPrefix(s, "-")
+	if digits == "" || digits[0] == '+' || (digits[0] == '0' && s != "0") {
+		return 0, errNotInteger
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, errNotInteger
+	}
+	return n, nil
+}
+
+// parseFloat parses a finite number written in decimal.
+func parseFloat(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, errNotFloat
+	}
+	return f, nil
+}
+
+// formatFloat writes f the way INCRBYFLOAT stores it: like Redis' %.17Lf,
+// in plain decimal without an exponent and without trailing zeros, but with
+// only as many digits as it takes to read f back, so 10.5+0.1 gives 10.6.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,99 @@
+package protocol
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// expireUnits maps the commands setting an expiry to the SET option that
+// takes the same kind of argument.
+var expireUnits = map[string]string{
+	"expire":    "EX",
+	"pexpire":   "PX",
+	"expireat":  "EXAT",
+	"pexpireat": "PXAT",
+}
+
+func errInvalidExpireTime(command string) error {
+	return fmt.Errorf("invalid expire time in '%s' command", command)
+}
+
+// expireTime returns the time named by n as the argument of an EX, PX, EXAT
+// or PXAT option of command: a number of seconds or milliseconds from now,
+// or a Unix time in seconds or milliseconds. Times that do not fit are an
+// error.
+func expireTime(option string, n int64, now time.Time, command string) (time.Time, error) {
+	ms := n
+	if option == "EX" || option == "EXAT" {
+		if n > math.MaxInt64/1000 || n < math.MinInt64/1000 {
+			return time.Time{}, errInvalidExpireTime(command)
+		}
+		ms = n * 1000
+	}
+	if option == "EX" || option == "PX" {
+		nowMs := now.UnixMilli()
+		if ms > math.MaxInt64-nowMs || ms < math.MinInt64+nowMs {
+			return time.Time{}, errInvalidExpireTime(command)
+		}
+		ms += nowMs
+	}
+	return time.UnixMilli(ms), nil
+}
+
+// expire sets when a key expires, relative to now with EXPIRE and PEXPIRE
+// or as a Unix time with EXPIREAT and PEXPIREAT. A time in the past deletes
+// the key. It replies 1, or 0 if the key does not exist.
+func (p *Protocol) expire(req *Request) (Reply, error) {
+	n, err := strconv.ParseInt(req.Args[1], 10, 64)
+	if err != nil {
+		return nil, errNotInteger
+	}
+	at, err := expireTime(expireUnits[req.Command.Name], n, time.Now(), req.Command.Name)
+	if err != nil {
+		return nil, err
+	}
+	found, err := p.store.Expire(req.Args[0], at)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return Integer(0), nil
+	}
+	return Integer(1), nil
+}
+
+// ttl replies how long a key has left to live, in seconds with TTL and in
+// milliseconds with PTTL: -1 if the key does not expire and -2 if it does
+// not exist.
+func (p *Protocol) ttl(req *Request) (Reply, error) {
+	at, found, err := p.store.ExpireTime(req.Args[0])
+	switch {
+	case err != nil:
+		return nil, err
+	case !found:
+		return Integer(-2), nil
+	case at.IsZero():
+		return Integer(-1), nil
+	}
+
+	left := max(time.Until(at).Milliseconds(), 0)
+	if req.Command.Name == "ttl" {
+		return Integer((left + 500) / 1000), nil
+	}
+	return Integer(left), nil
+}
+
+// persist removes the expiry of a key. It replies 1, or 0 if the key does
+// not exist or does not expire.
+func (p *Protocol) persist(req *Request) (Reply, error) {
+	removed, err := p.store.Persist(req.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	if !removed {
+		return Integer(0), nil
+	}
+	return Integer(1), nil
+}
@@ -0,0 +1,109 @@
+package protocol
+
+import "strings"
+
+// globMatch reports whether s matches the glob pattern, with the rules of
+// Redis: * matches any run of bytes, ? any single byte, and [abc], [a-z] or
+// [^a] a byte of a class. A backslash makes the byte after it literal, also
+// within a class.
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	// The position after the last star and the byte of s it was last
+	// tried to stop at, for backtracking.
+	star, starAt := -1, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				star, starAt = p+1, i
+				p++
+				continue
+			case '?':
+				p++
+				i++
+				continue
+			case '[':
+				if matched, end := matchClass(pattern, p, s[i]); matched {
+					p = end
+					i++
+					continue
+				}
+			case '\\':
+				// A trailing backslash stands for itself.
+				q := min(p+1, len(pattern)-1)
+				if pattern[q] == s[i] {
+					p = q + 1
+					i++
+					continue
+				}
+			default:
+				if pattern[p] == s[i] {
+					p++
+					i++
+					continue
+				}
+			}
+		}
+		// A mismatch: let the last star swallow one more byte, if there
+		// was a star.
+		if star < 0 {
+			return false
+		}
+		starAt++
+		p, i = star, starAt
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass reports whether c belongs to the class starting with the '['
+// at pattern[p], and returns the position just past the class. A class
+// missing its closing bracket extends to the end of the pattern.
+func matchClass(pattern string, p int, c byte) (bool, int) {
+	p++
+	negate := p < len(pattern) && pattern[p] == '^'
+	if negate {
+		p++
+	}
+	matched := false
+	for p < len(pattern) && pattern[p] != ']' {
+		switch {
+		case pattern[p] == '\\' && p+1 < len(pattern):
+			p++
+			matched = matched || pattern[p] == c
+		case p+2 < len(pattern) && pattern[p+1] == '-':
+			lo, hi := pattern[p], pattern[p+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (lo <= c && c <= hi)
+			p += 2
+		default:
+			matched = matched || pattern[p] == c
+		}
+		p++
+	}
+	if p < len(pattern) {
+		p++ // the closing bracket
+	}
+	return matched != negate, p
+}
+
+// globPrefix returns the literal prefix of pattern, which every string
+// matching the pattern starts with.
+func globPrefix(pattern string) string {
+	var prefix strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?', '[':
+			return prefix.String()
+		case '\\':
+			// A trailing backslash stands for itself.
+			i = min(i+1, len(pattern)-1)
+		}
+		prefix.WriteByte(pattern[i])
+	}
+	return prefix.String()
+}
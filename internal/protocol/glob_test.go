@@ -0,0 +1,55 @@
+package protocol
+
+import "testing"
+
+func TestGlobMatch(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"user:*", "user:42", true},
+		{"user:*", "users:42", false},
+		{"*:42", "user:42", true},
+		{"*a*b*c", "xxaxxbxxbxc", true},
+		{"*a*b*c", "xxaxxbxxbx", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[c-a]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{`[\]]`, "]", true},
+		{`a\`, `a\`, true},
+		{"[abc", "b", true},
+		{"", "", true},
+		{"", "a", false},
+		{"a**", "a", true},
+	} {
+		if got := globMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestGlobPrefix(t *testing.T) {
+	for pattern, want := range map[string]string{
+		"*":         "",
+		"user:*":    "user:",
+		"user:?:x":  "user:",
+		"a[bc]*":    "a",
+		`a\*b*`:     "a*b",
+		"exact":     "exact",
+		`trailing\`: `trailing\`,
+	} {
+		if got := globPrefix(pattern); got != want {
+			t.Errorf("globPrefix(%q) = %q, want %q", pattern, got, want)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CommandFlags describe how a command behaves.
+type CommandFlags uint8
+
+const (
+	// FlagReadonly marks commands that only read data.
+	FlagReadonly CommandFlags = 1 << iota
+	// FlagWrite marks commands that may modify data.
+	FlagWrite
+	// FlagAdmin marks commands that manage the server rather than data.
+	FlagAdmin
+)
+
+var flagNames = []struct {
+	flag CommandFlags
+	name string
+}{
+	{FlagReadonly, "readonly"},
+	{FlagWrite, "write"},
+	{FlagAdmin, "admin"},
+}
+
+// Names returns the names of the flags set, as COMMAND reports them.
+func (f CommandFlags) Names() []string {
+	names := []string{}
+	for _, fn := range flagNames {
+		if f&fn.flag != 0 {
+			names = append(names, fn.name)
+		}
+	}
+	return names
+}
+
+// Request is a command as a handler receives it.
+//
+// Fields:
+//   - Session: The connection the command came from.
+//   - Command: The command being run.
+//   - Args: The arguments following the command name.
+type Request struct {
+	Session *Session
+	Command *Command
+	Args    []string
+}
+
+// Handler runs a command. An error is sent to the client as an ERR reply.
+type Handler func(p *Protocol, req *Request) (Reply, error)
+
+// Command describes a command of the command table.
+//
+// Fields:
+//   - Name: The lower-case command name.
+//   - Arity: The number of arguments including the name. A negative arity
+//     -n means at least n.
+//   - Flags: How the command behaves.
+//   - FirstKey, LastKey, KeyStep: Where the keys are among the arguments,
+//     counting the name as 0. A negative LastKey counts from the end, so -1
+//     is the last argument. Commands without keys have all three at 0.
+//   - Group: The group COMMAND DOCS files the command under, such as string
+//     or keyspace.
+//   - Summary: What the command does, in one line.
+//   - Handler: Runs the command.
+type Command struct {
+	Name     string
+	Arity    int
+	Flags    CommandFlags
+	FirstKey int
+	LastKey  int
+	KeyStep  int
+	Group    string
+	Summary  string
+	Handler  Handler
+}
+
+// checkArity reports whether argc arguments, including the name, suit c.
+func (c *Command) checkArity(argc int) bool {
+	if c.Arity < 0 {
+		return argc >= -c.Arity
+	}
+	return argc == c.Arity
+}
+
+// categories returns the ACL categories of c, derived from its flags and
+// group.
+func (c *Command) categories() []string {
+	var categories []string
+	if c.Flags&FlagReadonly != 0 {
+		categories = append(categories, "@read")
+	}
+	if c.Flags&FlagWrite != 0 {
+		categories = append(categories, "@write")
+	}
+	if c.Flags&FlagAdmin != 0 {
+		categories = append(categories, "@admin", "@dangerous")
+	}
+	if c.Group != "" {
+		categories = append(categories, "@"+c.Group)
+	}
+	return categories
+}
+
+func simpleStrings(ss []string) Array {
+	reply := make(Array, len(ss))
+	for i, s := range ss {
+		reply[i] = SimpleString(s)
+	}
+	return reply
+}
+
+// infoReply describes c the way COMMAND INFO does: name, arity, flags, key
+// positions, ACL categories, tips, key specifications and subcommands.
+func (c *Command) infoReply() Reply {
+	return Array{
+		BulkString(c.Name),
+		Integer(c.Arity),
+		simpleStrings(c.Flags.Names()),
+		Integer(c.FirstKey),
+		Integer(c.LastKey),
+		Integer(c.KeyStep),
+		simpleStrings(c.categories()),
+		Array{},
+		Array{},
+		Array{},
+	}
+}
+
+// docsReply documents c the way COMMAND DOCS does.
+func (c *Command) docsReply() Reply {
+	return Map{
+		{"summary", BulkString(c.Summary)},
+		{"group", BulkString(c.Group)},
+	}
+}
+
+// Registry maps command names to commands.
+type Registry struct {
+	commands map[string]*Command
+	names    []string // in registration order
+}
+
+func NewRegistry(commands ...*Command) *Registry {
+	r := &Registry{commands: map[string]*Command{}}
+	for _, c := range commands {
+		r.Register(c)
+	}
+	return r
+}
+
+// Register adds c to the registry. Registering a name twice is a
+// programming error and panics.
+func (r *Registry) Register(c *Command) {
+	if _, ok := r.commands[c.Name]; ok {
+		panic(fmt.Sprintf("command %q registered twice", c.Name))
+	}
+	r.commands[c.Name] = c
+	r.names = append(r.names, c.Name)
+}
+
+// Lookup returns the command called name, in any case.
+func (r *Registry) Lookup(name string) (*Command, bool) {
+	c, ok := r.commands[strings.ToLower(name)]
+	return c, ok
+}
+
+// Commands returns every command in registration order.
+func (r *Registry) Commands() []*Command {
+	commands := make([]*Command, len(r.names))
+	for i, name := range r.names {
+		commands[i] = r.commands[name]
+	}
+	return commands
+}
@@ -0,0 +1,48 @@
+package protocol
+
+import "testing"
+
+func TestRegistryLookupAndArity(t *testing.T) {
+	r := NewRegistry(
+		&Command{Name: "get", Arity: 2},
+		&Command{Name: "hello", Arity: -1},
+	)
+	get, ok := r.Lookup("GeT")
+	if !ok || get.Name != "get" {
+		t.Fatalf("lookup is not case-insensitive: %v %v", get, ok)
+	}
+	if get.checkArity(1) || !get.checkArity(2) || get.checkArity(3) {
+		t.Error("fixed arity not enforced")
+	}
+	hello, _ := r.Lookup("hello")
+	if !hello.checkArity(1) || !hello.checkArity(4) {
+		t.Error("variadic arity rejects extra arguments")
+	}
+	if _, ok := r.Lookup("nope"); ok {
+		t.Error("unknown command found")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a name twice did not panic")
+		}
+	}()
+	r.Register(&Command{Name: "get", Arity: 2})
+}
+
+func TestCommandTableIsConsistent(t *testing.T) {
+	for _, c := range NewRegistry(commandTable...).Commands() {
+		if c.Handler == nil || c.Arity == 0 {
+			t.Errorf("%s: missing handler or arity", c.Name)
+		}
+		if c.Group == "" || c.Summary == "" {
+			t.Errorf("%s: undocumented", c.Name)
+		}
+		if c.FirstKey > 0 && (c.KeyStep <= 0 || (c.LastKey > 0 && c.LastKey < c.FirstKey)) {
+			t.Errorf("%s: inconsistent key positions", c.Name)
+		}
+		if c.Flags&FlagReadonly != 0 && c.Flags&FlagWrite != 0 {
+			t.Errorf("%s: both readonly and write", c.Name)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package protocol
+
+import "github.com/sebzz2k2/vaultic/internal/resp"
+
+// Protocol versions a connection can speak. Connections start with RESP2
+// and switch with HELLO.
+const (
+	RESP2 = 2
+	RESP3 = 3
+)
+
+// Session is the state of one client connection.
+//
+// Fields:
+//   - Proto: The RESP version replies are encoded in.
+//   - Name: The name the client gave itself with HELLO SETNAME.
+type Session struct {
+	Proto int
+	Name  string
+}
+
+func NewSession() *Session {
+	return &Session{Proto: RESP2}
+}
+
+// Reply is the typed result of a command. It is encoded in the protocol
+// version of the connection it is sent to.
+type Reply interface {
+	Encode(b *resp.Builder, proto int)
+}
+
+// SimpleString is a short status reply such as OK.
+type SimpleString string
+
+// BulkString is a binary-safe string.
+type BulkString string
+
+// Integer is a signed 64-bit integer.
+type Integer int64
+
+// Double is a floating point number.
+type Double float64
+
+// Null is the reply for a missing value.
+type Null struct{}
+
+// Array is an ordered list of replies.
+type Array []Reply
+
+// Map is a list of key and value pairs, kept in order.
+type Map []MapEntry
+
+type MapEntry struct {
+	Key   string
+	Value Reply
+}
+
+// Error is an error reply. Its text starts with an error code such as ERR.
+type Error string
+
+func (r SimpleString) Encode(b *resp.Builder, proto int) { b.SimpleString(string(r)) }
+
+func (r BulkString) Encode(b *resp.Builder, proto int) { b.Bulk(string(r)) }
+
+func (r Integer) Encode(b *resp.Builder, proto int) { b.Integer(int64(r)) }
+
+// Encode writes a RESP3 double, or under RESP2 a bulk string holding the
+// number.
+func (r Double) Encode(b *resp.Builder, proto int) {
+	if proto >= RESP3 {
+		b.Double(float64(r))
+	} else {
+		b.Bulk(formatFloat(float64(r)))
+	}
+}
+
+func (r Error) Encode(b *resp.Builder, proto int) { b.Error(string(r)) }
+
+func (Null) Encode(b *resp.Builder, proto int) {
+	if proto >= RESP3 {
+		b.Null()
+	} else {
+		b.NullBulk()
+	}
+}
+
+func (r Array) Encode(b *resp.Builder, proto int) {
+	b.ArrayHeader(len(r))
+	for _, e := range r {
+		e.Encode(b, proto)
+	}
+}
+
+// Encode writes a RESP3 map, or under RESP2 an array of alternating keys and
+// values.
+func (r Map) Encode(b *resp.Builder, proto int) {
+	if proto >= RESP3 {
+		b.MapHeader(len(r))
+	} else {
+		b.ArrayHeader(2 * len(r))
+	}
+	for _, e := range r {
+		b.Bulk(e.Key)
+		e.Value.Encode(b, proto)
+	}
+}
+
+// EncodeReply returns r encoded in the protocol version proto.
+func EncodeReply(r Reply, proto int) string {
+	b := resp.NewBuilder(false)
+	r.Encode(b, proto)
+	return b.Build()
+}
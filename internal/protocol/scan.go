@@ -0,0 +1,117 @@
+package protocol
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// maxScanCursors is the number of SCAN cursors remembered. A cursor
+	// older than that is rejected.
+	maxScanCursors = 1 << 16
+
+	defaultScanCount = 10
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// cursorTable hands out the cursors of SCAN. Keys are scanned in order, so a
+// scan resumes from a key, but clients expect cursors to be numbers; every
+// cursor handed out names the key its scan resumes from. Cursor 0 starts a
+// scan, and ends it when returned. Cursors do not survive a restart.
+type cursorTable struct {
+	mu   sync.Mutex
+	last uint64
+	keys map[uint64]string
+}
+
+func newCursorTable() *cursorTable {
+	return &cursorTable{keys: map[uint64]string{}}
+}
+
+// put returns a new cursor for resuming a scan at key, forgetting the
+// oldest cursor if there are too many.
+func (t *cursorTable) put(key string) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.last++
+	t.keys[t.last] = key
+	if t.last > maxScanCursors {
+		delete(t.keys, t.last-maxScanCursors)
+	}
+	return t.last
+}
+
+// get returns the key the scan of cursor resumes from.
+func (t *cursorTable) get(cursor uint64) (string, bool) {
+	if cursor == 0 {
+		return "", true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key, ok := t.keys[cursor]
+	return key, ok
+}
+
+// scan walks part of the keyspace: SCAN cursor [MATCH pattern] [COUNT count]
+// [TYPE type]. COUNT is the number of keys walked, of which only those
+// matching the pattern and type are returned. It replies the cursor to
+// continue with and the keys found.
+func (p *Protocol) scan(req *Request) (Reply, error) {
+	cursor, err := strconv.ParseUint(req.Args[0], 10, 64)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	start, ok := p.cursors.get(cursor)
+	if !ok {
+		return nil, errInvalidCursor
+	}
+
+	count, pattern, wantStrings := defaultScanCount, "*", true
+	for args := req.Args[1:]; len(args) > 0; args = args[2:] {
+		if len(args) < 2 {
+			return nil, errSyntax
+		}
+		switch strings.ToUpper(args[0]) {
+		case "MATCH":
+			pattern = args[1]
+		case "COUNT":
+			n, err := strconv.Atoi(args[1])
+			if err != nil {
+				return nil, errNotInteger
+			}
+			if n < 1 {
+				return nil, errSyntax
+			}
+			count = n
+		case "TYPE":
+			// Every value is a string.
+			wantStrings = strings.EqualFold(args[1], "string")
+		default:
+			return nil, errSyntax
+		}
+	}
+
+	var match func(key string) bool
+	switch {
+	case !wantStrings:
+		match = func(string) bool { return false }
+	case pattern != "*":
+		match = func(key string) bool { return globMatch(pattern, key) }
+	}
+	keys, next, err := p.store.Scan(start, count, match)
+	if err != nil {
+		return nil, err
+	}
+	nextCursor := uint64(0)
+	if next != "" {
+		nextCursor = p.cursors.put(next)
+	}
+	found := make(Array, len(keys))
+	for i, key := range keys {
+		found[i] = BulkString(key)
+	}
+	return Array{BulkString(strconv.FormatUint(nextCursor, 10)), found}, nil
+}
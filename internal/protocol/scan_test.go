@@ -0,0 +1,33 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCursorTable(t *testing.T) {
+	cursors := newCursorTable()
+	if key, ok := cursors.get(0); !ok || key != "" {
+		t.Fatalf("cursor 0 = %q, %v, want a scan from the start", key, ok)
+	}
+
+	long := strings.Repeat("k", 300)
+	first := cursors.put(long)
+	if key, ok := cursors.get(first); !ok || key != long {
+		t.Fatalf("cursor %d = %q, %v, want the key it was made for", first, key, ok)
+	}
+	// Reading a cursor does not use it up.
+	if _, ok := cursors.get(first); !ok {
+		t.Fatalf("cursor %d was forgotten after one use", first)
+	}
+
+	for i := 0; i < maxScanCursors; i++ {
+		cursors.put("k")
+	}
+	if _, ok := cursors.get(first); ok {
+		t.Fatalf("cursor %d survived %d newer cursors", first, maxScanCursors)
+	}
+	if _, ok := cursors.get(first + maxScanCursors); !ok {
+		t.Fatal("newest cursor was forgotten")
+	}
+}
@@ -0,0 +1,168 @@
+package protocol
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sebzz2k2/vaultic/internal/storage"
+)
+
+// maxStringSize is the length of the longest value APPEND and SETRANGE
+// build, 512 MiB as in Redis and as the default bulk length limit of the
+// server, so that a value built here can also be written by a client.
+const maxStringSize = 512 << 20
+
+var (
+	errStringTooLarge = errors.New("string exceeds maximum allowed size (proto-max-bulk-len)")
+	errOffsetRange    = errors.New("offset is out of range")
+)
+
+// getdel replies the value of a key and deletes the key, or replies a null
+// if it does not exist.
+func (p *Protocol) getdel(req *Request) (Reply, error) {
+	value, found, err := p.store.GetDel(req.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return Null{}, nil
+	}
+	return BulkString(value), nil
+}
+
+// getex replies the value of a key, or a null if it does not exist, and
+// changes its expiry: GETEX key [EX seconds | PX milliseconds | EXAT
+// unix-time-seconds | PXAT unix-time-milliseconds | PERSIST].
+func (p *Protocol) getex(req *Request) (Reply, error) {
+	var opts storage.GetExOptions
+	args := req.Args[1:]
+	option := ""
+	if len(args) > 0 {
+		option = strings.ToUpper(args[0])
+	}
+	switch {
+	case len(args) == 0:
+	case len(args) == 1 && option == "PERSIST":
+		opts.Persist = true
+	case len(args) == 2 && (option == "EX" || option == "PX" || option == "EXAT" || option == "PXAT"):
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return nil, errNotInteger
+		}
+		if n <= 0 {
+			return nil, errInvalidExpireTime("getex")
+		}
+		if opts.ExpireAt, err = expireTime(option, n, time.Now(), "getex"); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errSyntax
+	}
+
+	value, found, err := p.store.GetEx(req.Args[0], opts)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return Null{}, nil
+	}
+	return BulkString(value), nil
+}
+
+// append appends to the value of a key, creating the key if it does not
+// exist, and replies the length of the new value.
+func (p *Protocol) append(req *Request) (Reply, error) {
+	suffix := req.Args[1]
+	value, err := p.store.Update(req.Args[0], func(value string, found bool) (string, error) {
+		if len(value)+len(suffix) > maxStringSize {
+			return "", errStringTooLarge
+		}
+		return value + suffix, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return Integer(len(value)), nil
+}
+
+// strlen replies the length of the value of a key, 0 if it does not exist.
+func (p *Protocol) strlen(req *Request) (Reply, error) {
+	value, _, err := p.store.Get(req.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	return Integer(len(value)), nil
+}
+
+// getrange replies the bytes of a value from start to end, both included.
+// Negative offsets count from the end of the value, and offsets beyond
+// either end are clamped to it. A missing key reads as an empty value.
+func (p *Protocol) getrange(req *Request) (Reply, error) {
+	start, err := strconv.ParseInt(req.Args[1], 10, 64)
+	if err != nil {
+		return nil, errNotInteger
+	}
+	end, err := strconv.ParseInt(req.Args[2], 10, 64)
+	if err != nil {
+		return nil, errNotInteger
+	}
+	value, _, err := p.store.GetRange(req.Args[0], func(size int) (int, int) {
+		n := int64(size)
+		if start < 0 && end < 0 && start > end {
+			return 0, 0
+		}
+		if start < 0 {
+			start = max(n+start, 0)
+		}
+		if end < 0 {
+			end = max(n+end, 0)
+		}
+		end = min(end, n-1)
+		if start > end || n == 0 {
+			return 0, 0
+		}
+		return int(start), int(end + 1)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return BulkString(value), nil
+}
+
+// setrange overwrites the value of a key from offset on, padding it with
+// zero bytes if it is shorter than offset, and replies the length of the new
+// value. Writing an empty string changes nothing.
+func (p *Protocol) setrange(req *Request) (Reply, error) {
+	offset, err := strconv.ParseInt(req.Args[1], 10, 64)
+	if err != nil {
+		return nil, errNotInteger
+	}
+	if offset < 0 {
+		return nil, errOffsetRange
+	}
+	patch := req.Args[2]
+	if patch == "" {
+		value, _, err := p.store.Get(req.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		return Integer(len(value)), nil
+	}
+	if offset+int64(len(patch)) > maxStringSize {
+		return nil, errStringTooLarge
+	}
+
+	value, err := p.store.Update(req.Args[0], func(value string, found bool) (string, error) {
+		end := int(offset) + len(patch)
+		b := make([]byte, max(len(value), end))
+		copy(b, value)
+		copy(b[offset:], patch)
+		return string(b), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return Integer(len(value)), nil
+}
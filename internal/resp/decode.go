@@ -3,6 +3,7 @@ package resp
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"io"
 	"math"
 	"math/big"
@@ -10,8 +11,41 @@ import (
 	"strings"
 )
 
+// ErrLimitExceeded is returned by a Decoder when a value breaks one of its
+// Limits.
+var ErrLimitExceeded = errors.New("limit exceeded")
+
+// ErrMalformed is returned by a Decoder when its input is not valid RESP.
+// Like ErrLimitExceeded it leaves the reader in the middle of a value.
+var ErrMalformed = errors.New("malformed request")
+
+// maxPrealloc caps the elements allocated for an aggregate up front, before
+// they have actually been received.
+const maxPrealloc = 1024
+
+// Limits bound what a Decoder accepts, so that a peer cannot make it
+// allocate unbounded memory. A zero field means no limit.
+//
+// Fields:
+//   - MaxBulkLength: The longest bulk string, bulk error or verbatim string
+//     in bytes.
+//   - MaxArrayLength: The most elements of an array, set or push, and the
+//     most pairs of a map or attribute.
+//   - MaxDepth: How deeply aggregates may nest; a flat array has depth 1.
+//   - MaxSize: The most bytes one value, with everything nested in it, may
+//     take on the wire.
+type Limits struct {
+	MaxBulkLength  int
+	MaxArrayLength int
+	MaxDepth       int
+	MaxSize        int
+}
+
 type Decoder struct {
 	reader *bufio.Reader
+	limits Limits
+	depth  int // aggregates entered by the value being decoded
+	size   int // bytes read of the value being decoded
 }
 
 type RESPValue struct {
@@ -27,15 +61,35 @@ type RESPValue struct {
 	Error  string
 }
 
+// NewDecoder returns a decoder reading from r. A *bufio.Reader is used as
+// is, so that bytes it already buffered are not lost between decoders.
 func NewDecoder(r io.Reader) *Decoder {
+	if br, ok := r.(*bufio.Reader); ok {
+		return &Decoder{reader: br}
+	}
 	return &Decoder{reader: bufio.NewReader(r)}
 }
 
+// NewDecoderWithLimits returns a decoder reading from r that rejects values
+// breaking limits with an error wrapping ErrLimitExceeded. What follows such
+// a value on r cannot be decoded anymore.
+func NewDecoderWithLimits(r io.Reader, limits Limits) *Decoder {
+	d := NewDecoder(r)
+	d.limits = limits
+	return d
+}
+
 func (d *Decoder) Decode() (*RESPValue, error) {
+	if d.depth == 0 {
+		d.size = 0
+	}
 	typeByte, err := d.reader.ReadByte()
 	if err != nil {
 		return nil, err
 	}
+	if err := d.consume(1); err != nil {
+		return nil, err
+	}
 
 	switch typeByte {
 	case respTypeToChar[SIMPLE_STRING]:
@@ -69,19 +123,129 @@ func (d *Decoder) Decode() (*RESPValue, error) {
 	case respTypeToChar[PUSH]:
 		return d.decodePush()
 	default:
-		return nil, errors.New("unknown RESP type: " + string(typeByte))
+		return nil, fmt.Errorf("%w: unknown RESP type %q", ErrMalformed, typeByte)
+	}
+}
+
+// consume accounts for n more bytes of the value being decoded.
+func (d *Decoder) consume(n int) error {
+	d.size += n
+	if d.limits.MaxSize > 0 && d.size > d.limits.MaxSize {
+		return fmt.Errorf("%w: request larger than %d bytes", ErrLimitExceeded, d.limits.MaxSize)
 	}
+	return nil
 }
 
+// enter descends into an aggregate; leave must be called when it is done.
+func (d *Decoder) enter() error {
+	if d.limits.MaxDepth > 0 && d.depth >= d.limits.MaxDepth {
+		return fmt.Errorf("%w: nesting deeper than %d", ErrLimitExceeded, d.limits.MaxDepth)
+	}
+	d.depth++
+	return nil
+}
+
+func (d *Decoder) leave() {
+	d.depth--
+}
+
+// readRawLine reads up to and including the next LF, checking the size of
+// the line as it grows rather than once it is complete.
+func (d *Decoder) readRawLine() ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := d.reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if err := d.consume(len(chunk)); err != nil {
+			return nil, err
+		}
+		if err == nil {
+			return line, nil
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, err
+		}
+	}
+}
+
+// readLine reads a line ending in CRLF and returns it without the CRLF.
 func (d *Decoder) readLine() (string, error) {
-	line, err := d.reader.ReadString('\n')
+	line, err := d.readRawLine()
 	if err != nil {
 		return "", err
 	}
 	if len(line) < 2 || line[len(line)-2] != '\r' {
-		return "", errors.New("invalid CRLF terminator")
+		return "", fmt.Errorf("%w: invalid CRLF terminator", ErrMalformed)
+	}
+	return string(line[:len(line)-2]), nil
+}
+
+// readLength reads the length line of a bulk string or an aggregate; kind
+// names which for errors.
+func (d *Decoder) readLength(kind string) (int, error) {
+	lengthStr, err := d.readLine()
+	if err != nil {
+		return 0, err
+	}
+	length, err := strconv.Atoi(lengthStr)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid %s length %q", ErrMalformed, kind, lengthStr)
 	}
-	return line[:len(line)-2], nil
+	return length, nil
+}
+
+// readBulkLength reads the length of a bulk string and reserves its payload
+// against the size limit, before anything is allocated for it. Only a
+// nullable bulk string may have length -1.
+func (d *Decoder) readBulkLength(nullable bool) (int, error) {
+	length, err := d.readLength("bulk")
+	if err != nil {
+		return 0, err
+	}
+	if length == -1 && nullable {
+		return length, nil
+	}
+	if length < 0 {
+		return 0, fmt.Errorf("%w: invalid bulk length %d", ErrMalformed, length)
+	}
+	if d.limits.MaxBulkLength > 0 && length > d.limits.MaxBulkLength {
+		return 0, fmt.Errorf("%w: bulk length %d larger than %d", ErrLimitExceeded, length, d.limits.MaxBulkLength)
+	}
+	return length, d.consume(length)
+}
+
+// readAggregateLength reads the number of elements of an aggregate. Only a
+// nullable aggregate may have length -1.
+func (d *Decoder) readAggregateLength(nullable bool) (int, error) {
+	length, err := d.readLength("aggregate")
+	if err != nil {
+		return 0, err
+	}
+	if length == -1 && nullable {
+		return length, nil
+	}
+	if length < 0 {
+		return 0, fmt.Errorf("%w: invalid aggregate length %d", ErrMalformed, length)
+	}
+	if d.limits.MaxArrayLength > 0 && length > d.limits.MaxArrayLength {
+		return 0, fmt.Errorf("%w: %d elements, more than %d", ErrLimitExceeded, length, d.limits.MaxArrayLength)
+	}
+	return length, nil
+}
+
+// readCRLF consumes the CRLF that ends the payload of a bulk string.
+func (d *Decoder) readCRLF() error {
+	var crlf [2]byte
+	if _, err := io.ReadFull(d.reader, crlf[:]); err != nil {
+		return err
+	}
+	if err := d.consume(2); err != nil {
+		return err
+	}
+	if string(crlf[:]) != CRLF {
+		return fmt.Errorf("%w: invalid CRLF terminator", ErrMalformed)
+	}
+	return nil
 }
 
 func (d *Decoder) decodeSimpleString() (*RESPValue, error) {
@@ -107,18 +271,13 @@ func (d *Decoder) decodeInteger() (*RESPValue, error) {
 	}
 	val, err := strconv.ParseInt(str, 10, 64)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: invalid integer %q", ErrMalformed, str)
 	}
 	return &RESPValue{Type: INTEGER, Int: val}, nil
 }
 
 func (d *Decoder) decodeBulkString() (*RESPValue, error) {
-	lengthStr, err := d.readLine()
-	if err != nil {
-		return nil, err
-	}
-
-	length, err := strconv.Atoi(lengthStr)
+	length, err := d.readBulkLength(true)
 	if err != nil {
 		return nil, err
 	}
@@ -127,43 +286,39 @@ func (d *Decoder) decodeBulkString() (*RESPValue, error) {
 		return &RESPValue{Type: BULK_STRING, Null: true}, nil
 	}
 
-	if length == 0 {
-		d.readLine()
-		return &RESPValue{Type: BULK_STRING, String: ""}, nil
-	}
-
 	data := make([]byte, length)
 	_, err = io.ReadFull(d.reader, data)
 	if err != nil {
 		return nil, err
 	}
 
-	d.readLine()
+	if err := d.readCRLF(); err != nil {
+		return nil, err
+	}
 	return &RESPValue{Type: BULK_STRING, String: string(data)}, nil
 }
 
 func (d *Decoder) decodeArray() (*RESPValue, error) {
-	lengthStr, err := d.readLine()
+	length, err := d.readAggregateLength(true)
 	if err != nil {
 		return nil, err
 	}
-
-	length, err := strconv.Atoi(lengthStr)
-	if err != nil {
+	if err := d.enter(); err != nil {
 		return nil, err
 	}
+	defer d.leave()
 
 	if length == -1 {
 		return &RESPValue{Type: ARRAY, Null: true}, nil
 	}
 
-	array := make([]RESPValue, length)
+	array := make([]RESPValue, 0, min(length, maxPrealloc))
 	for i := 0; i < length; i++ {
 		val, err := d.Decode()
 		if err != nil {
 			return nil, err
 		}
-		array[i] = *val
+		array = append(array, *val)
 	}
 
 	return &RESPValue{Type: ARRAY, Array: array}, nil
@@ -189,7 +344,7 @@ func (d *Decoder) decodeBoolean() (*RESPValue, error) {
 		return &RESPValue{Type: BOOLEAN, Bool: false}, nil
 	}
 
-	return nil, errors.New("invalid boolean value: " + str)
+	return nil, fmt.Errorf("%w: invalid boolean value %q", ErrMalformed, str)
 }
 
 func (d *Decoder) decodeDouble() (*RESPValue, error) {
@@ -209,7 +364,7 @@ func (d *Decoder) decodeDouble() (*RESPValue, error) {
 
 	val, err := strconv.ParseFloat(str, 64)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: invalid double %q", ErrMalformed, str)
 	}
 	return &RESPValue{Type: DOUBLE, Float: val}, nil
 }
@@ -223,19 +378,14 @@ func (d *Decoder) decodeBigNumber() (*RESPValue, error) {
 	bigInt := new(big.Int)
 	_, ok := bigInt.SetString(str, 10)
 	if !ok {
-		return nil, errors.New("invalid big number: " + str)
+		return nil, fmt.Errorf("%w: invalid big number %q", ErrMalformed, str)
 	}
 
 	return &RESPValue{Type: BIG_NUMBER, BigInt: bigInt}, nil
 }
 
 func (d *Decoder) decodeBulkError() (*RESPValue, error) {
-	lengthStr, err := d.readLine()
-	if err != nil {
-		return nil, err
-	}
-
-	length, err := strconv.Atoi(lengthStr)
+	length, err := d.readBulkLength(false)
 	if err != nil {
 		return nil, err
 	}
@@ -246,17 +396,14 @@ func (d *Decoder) decodeBulkError() (*RESPValue, error) {
 		return nil, err
 	}
 
-	d.readLine()
+	if err := d.readCRLF(); err != nil {
+		return nil, err
+	}
 	return &RESPValue{Type: BULK_ERROR, Error: string(data)}, nil
 }
 
 func (d *Decoder) decodeVerbatimString() (*RESPValue, error) {
-	lengthStr, err := d.readLine()
-	if err != nil {
-		return nil, err
-	}
-
-	length, err := strconv.Atoi(lengthStr)
+	length, err := d.readBulkLength(false)
 	if err != nil {
 		return nil, err
 	}
@@ -267,7 +414,9 @@ func (d *Decoder) decodeVerbatimString() (*RESPValue, error) {
 		return nil, err
 	}
 
-	d.readLine()
+	if err := d.readCRLF(); err != nil {
+		return nil, err
+	}
 
 	content := string(data)
 	if len(content) >= 4 && content[3] == respTypeToChar[INTEGER] {
@@ -278,15 +427,14 @@ func (d *Decoder) decodeVerbatimString() (*RESPValue, error) {
 }
 
 func (d *Decoder) decodeMap() (*RESPValue, error) {
-	lengthStr, err := d.readLine()
+	length, err := d.readAggregateLength(false)
 	if err != nil {
 		return nil, err
 	}
-
-	length, err := strconv.Atoi(lengthStr)
-	if err != nil {
+	if err := d.enter(); err != nil {
 		return nil, err
 	}
+	defer d.leave()
 
 	m := make(map[string]RESPValue)
 	for i := 0; i < length; i++ {
@@ -307,15 +455,14 @@ func (d *Decoder) decodeMap() (*RESPValue, error) {
 }
 
 func (d *Decoder) decodeAttribute() (*RESPValue, error) {
-	lengthStr, err := d.readLine()
+	length, err := d.readAggregateLength(false)
 	if err != nil {
 		return nil, err
 	}
-
-	length, err := strconv.Atoi(lengthStr)
-	if err != nil {
+	if err := d.enter(); err != nil {
 		return nil, err
 	}
+	defer d.leave()
 
 	m := make(map[string]RESPValue)
 	for i := 0; i < length; i++ {
@@ -336,46 +483,44 @@ func (d *Decoder) decodeAttribute() (*RESPValue, error) {
 }
 
 func (d *Decoder) decodeSet() (*RESPValue, error) {
-	lengthStr, err := d.readLine()
+	length, err := d.readAggregateLength(false)
 	if err != nil {
 		return nil, err
 	}
-
-	length, err := strconv.Atoi(lengthStr)
-	if err != nil {
+	if err := d.enter(); err != nil {
 		return nil, err
 	}
+	defer d.leave()
 
-	array := make([]RESPValue, length)
+	array := make([]RESPValue, 0, min(length, maxPrealloc))
 	for i := 0; i < length; i++ {
 		val, err := d.Decode()
 		if err != nil {
 			return nil, err
 		}
-		array[i] = *val
+		array = append(array, *val)
 	}
 
 	return &RESPValue{Type: SET, Array: array}, nil
 }
 
 func (d *Decoder) decodePush() (*RESPValue, error) {
-	lengthStr, err := d.readLine()
+	length, err := d.readAggregateLength(false)
 	if err != nil {
 		return nil, err
 	}
-
-	length, err := strconv.Atoi(lengthStr)
-	if err != nil {
+	if err := d.enter(); err != nil {
 		return nil, err
 	}
+	defer d.leave()
 
-	array := make([]RESPValue, length)
+	array := make([]RESPValue, 0, min(length, maxPrealloc))
 	for i := 0; i < length; i++ {
 		val, err := d.Decode()
 		if err != nil {
 			return nil, err
 		}
-		array[i] = *val
+		array = append(array, *val)
 	}
 
 	return &RESPValue{Type: PUSH, Array: array}, nil
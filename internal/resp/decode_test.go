@@ -0,0 +1,53 @@
+package resp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDecoderLimits(t *testing.T) {
+	limits := Limits{MaxBulkLength: 16, MaxArrayLength: 4, MaxDepth: 2, MaxSize: 64}
+	for _, tt := range []struct {
+		name  string
+		input string
+		err   bool
+	}{
+		{"within limits", "*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n", false},
+		{"huge array", "*2147483647\r\n", true},
+		{"huge bulk", "*1\r\n$2147483647\r\n", true},
+		{"bulk over limit", "$17\r\n" + strings.Repeat("x", 17) + "\r\n", true},
+		{"array over limit", "*5\r\n", true},
+		{"too deep", "*1\r\n*1\r\n*1\r\n$1\r\nx\r\n", true},
+		{"request over limit", "*4\r\n" + strings.Repeat("$16\r\n"+strings.Repeat("x", 16)+"\r\n", 4), true},
+		{"endless line", "+" + strings.Repeat("x", 100), true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewDecoderWithLimits(strings.NewReader(tt.input), limits).Decode()
+			if tt.err != errors.Is(err, ErrLimitExceeded) {
+				t.Fatalf("got %v, want limit exceeded: %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestDecoderResetsSizeBetweenValues(t *testing.T) {
+	value := "*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n"
+	d := NewDecoderWithLimits(strings.NewReader(strings.Repeat(value, 10)), Limits{MaxSize: len(value)})
+	for i := 0; i < 10; i++ {
+		if _, err := d.Decode(); err != nil {
+			t.Fatalf("value %d: %v", i, err)
+		}
+	}
+}
+
+func TestDecoderRejectsMalformedInput(t *testing.T) {
+	for _, input := range []string{
+		"*-2\r\n", "%-1\r\n", "$-2\r\n", "!-1\r\n", "$abc\r\n", "*1\n",
+		"?x\r\n", ":1.5\r\n", "#x\r\n", ",one\r\n", "(12a\r\n", "$1\r\nab\r\n",
+	} {
+		if _, err := DecodeString(input); !errors.Is(err, ErrMalformed) {
+			t.Errorf("%q: got %v, want a malformed request error", input, err)
+		}
+	}
+}
@@ -29,7 +29,10 @@ func (b *Builder) SimpleString(s string) *Builder {
 	return b
 }
 
+// Error writes a simple error. An error is a single line, so line breaks in
+// err are replaced by spaces.
 func (b *Builder) Error(err string) *Builder {
+	err = strings.NewReplacer("\r", " ", "\n", " ").Replace(err)
 	b.sb.WriteString(string(respTypeToChar[ERROR]) + err + b.crlf)
 	return b
 }
@@ -52,6 +55,25 @@ func (b *Builder) Array(elements []string) *Builder {
 	return b
 }
 
+// ArrayHeader starts an array of n elements, which the caller writes next.
+func (b *Builder) ArrayHeader(n int) *Builder {
+	b.sb.WriteString(fmt.Sprintf("%c%d%s", respTypeToChar[ARRAY], n, b.crlf))
+	return b
+}
+
+// MapHeader starts a map of n pairs, whose keys and values the caller
+// writes next.
+func (b *Builder) MapHeader(n int) *Builder {
+	b.sb.WriteString(fmt.Sprintf("%c%d%s", respTypeToChar[MAP], n, b.crlf))
+	return b
+}
+
+// NullBulk writes the RESP2 null, a bulk string of length -1.
+func (b *Builder) NullBulk() *Builder {
+	b.sb.WriteString(fmt.Sprintf("%c-1%s", respTypeToChar[BULK_STRING], b.crlf))
+	return b
+}
+
 func (b *Builder) Null() *Builder {
 	b.sb.WriteString(string(respTypeToChar[NULL]) + b.crlf)
 	return b
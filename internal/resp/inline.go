@@ -0,0 +1,135 @@
+package resp
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ErrUnbalancedQuotes is returned by SplitArgs for a quote that is not
+// closed, or not followed by a space.
+var ErrUnbalancedQuotes = errors.New("unbalanced quotes in request")
+
+// SplitArgs splits an inline command such as `SET key "a value"` into its
+// arguments, following the quoting rules of redis-cli. Arguments are
+// separated by spaces. Within double quotes, \n, \r, \t, \b, \a and \xHH
+// stand for the bytes they name, and a backslash makes any other character
+// literal. Within single quotes only \' is special.
+func SplitArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var arg strings.Builder
+		inDouble, inSingle, done := false, false, false
+		for !done {
+			if i == len(line) {
+				if inDouble || inSingle {
+					return nil, ErrUnbalancedQuotes
+				}
+				break
+			}
+			c := line[i]
+			switch {
+			case inDouble:
+				switch {
+				case c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+					b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					arg.WriteByte(byte(b))
+					i += 3
+				case c == '\\' && i+1 < len(line):
+					i++
+					arg.WriteByte(unescape(line[i]))
+				case c == '"':
+					// The closing quote must end the argument.
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, ErrUnbalancedQuotes
+					}
+					done = true
+				default:
+					arg.WriteByte(c)
+				}
+			case inSingle:
+				switch {
+				case c == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					i++
+					arg.WriteByte('\'')
+				case c == '\'':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, ErrUnbalancedQuotes
+					}
+					done = true
+				default:
+					arg.WriteByte(c)
+				}
+			default:
+				switch {
+				case isSpace(c):
+					done = true
+				case c == '"':
+					inDouble = true
+				case c == '\'':
+					inSingle = true
+				default:
+					arg.WriteByte(c)
+				}
+			}
+			i++
+		}
+		args = append(args, arg.String())
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func unescape(c byte) byte {
+	switch c {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	default:
+		return c
+	}
+}
+
+// IsInline reports whether the next request starts with something other
+// than a RESP array, and so is an inline command. It blocks until at least
+// one byte is available.
+func (d *Decoder) IsInline() (bool, error) {
+	b, err := d.reader.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	return b[0] != respTypeToChar[ARRAY], nil
+}
+
+// DecodeInline reads an inline command, a single line ending in LF or CRLF,
+// and splits it into its arguments. The line counts against MaxSize. An
+// empty line gives no arguments.
+func (d *Decoder) DecodeInline() ([]string, error) {
+	d.size = 0
+	line, err := d.readRawLine()
+	if err != nil {
+		return nil, err
+	}
+	return SplitArgs(strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"))
+}
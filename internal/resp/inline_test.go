@@ -0,0 +1,59 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	for _, tt := range []struct {
+		line string
+		args []string
+	}{
+		{"SET foo bar", []string{"SET", "foo", "bar"}},
+		{"  GET   foo  ", []string{"GET", "foo"}},
+		{"", nil},
+		{`SET k "hello world"`, []string{"SET", "k", "hello world"}},
+		{`SET k "a\r\nb\t\"c\"\\"`, []string{"SET", "k", "a\r\nb\t\"c\"\\"}},
+		{`SET k "\x00\xff\x4A"`, []string{"SET", "k", "\x00\xffJ"}},
+		{`SET k 'it\'s "raw" \n'`, []string{"SET", "k", `it's "raw" \n`}},
+		{`SET k ""`, []string{"SET", "k", ""}},
+		{`SET k""`, []string{"SET", "k"}},
+	} {
+		args, err := SplitArgs(tt.line)
+		if err != nil || fmt.Sprintf("%q", args) != fmt.Sprintf("%q", tt.args) {
+			t.Errorf("SplitArgs(%q) = %q, %v; want %q", tt.line, args, err, tt.args)
+		}
+	}
+
+	for _, line := range []string{`SET k "open`, `SET k 'open`, `SET k "a"b`, `SET k 'a'b`} {
+		if _, err := SplitArgs(line); !errors.Is(err, ErrUnbalancedQuotes) {
+			t.Errorf("SplitArgs(%q): expected unbalanced quotes, got %v", line, err)
+		}
+	}
+}
+
+func TestDecodeInline(t *testing.T) {
+	d := NewDecoder(strings.NewReader("SET a \"b c\"\r\n*1\r\n$4\r\nPING\r\nGET a\n"))
+	for _, want := range []string{`["SET" "a" "b c"]`, `["PING"]`, `["GET" "a"]`} {
+		inline, err := d.IsInline()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var args []string
+		if inline {
+			args, err = d.DecodeInline()
+		} else {
+			var v *RESPValue
+			v, err = d.Decode()
+			for _, e := range v.Array {
+				args = append(args, e.String)
+			}
+		}
+		if err != nil || fmt.Sprintf("%q", args) != want {
+			t.Fatalf("got %q %v, want %s", args, err, want)
+		}
+	}
+}
@@ -6,26 +6,39 @@ import (
 	"fmt"
 	"net"
 
-	"github.com/sebzz2k2/vaultic/internal/protocol/lexer"
+	"github.com/sebzz2k2/vaultic/internal/protocol"
 	"github.com/sebzz2k2/vaultic/internal/resp"
-	"github.com/sebzz2k2/vaultic/internal/storage"
 )
 
 type Client struct {
-	conn   net.Conn
-	engine storage.StorageEngine
-	config *Config
-	reader *bufio.Reader
-	writer *bufio.Writer
+	conn     net.Conn
+	config   *Config
+	protocol *protocol.Protocol
+	reader   *bufio.Reader
+	writer   *bufio.Writer
+
+	// decoder reads every command of the connection, so that bytes it has
+	// buffered ahead belong to the next command rather than being lost.
+	decoder *resp.Decoder
+	session *protocol.Session
 }
 
-func NewClient(conn net.Conn, config *Config, engine storage.StorageEngine) *Client {
+func NewClient(conn net.Conn, config *Config, proto *protocol.Protocol) *Client {
+	reader := bufio.NewReader(conn)
 	return &Client{
-		conn:   conn,
-		engine: engine,
-		config: config,
-		reader: bufio.NewReader(conn),
-		writer: bufio.NewWriter(conn),
+		conn:     conn,
+		config:   config,
+		protocol: proto,
+		reader:   reader,
+		writer:   bufio.NewWriter(conn),
+
+		decoder: resp.NewDecoderWithLimits(reader, resp.Limits{
+			MaxBulkLength:  config.MaxBulkLength,
+			MaxArrayLength: config.MaxArrayLength,
+			MaxDepth:       config.MaxNestingDepth,
+			MaxSize:        config.MaxMessageSize,
+		}),
+		session: protocol.NewSession(),
 	}
 }
 
@@ -38,36 +51,87 @@ func (c *Client) read() ([]byte, error) {
 	return b[:bn], nil
 }
 
+// Handle serves the commands of the connection until it fails or is closed.
+// Replies are buffered while more commands are already waiting in the
+// reader, so a pipeline of commands is answered with few writes, in order.
 func (c *Client) Handle() error {
 	fmt.Println("Client connected:", c.conn.RemoteAddr().String())
-	// defer c.writer.Flush()
+	defer c.writer.Flush()
 
 	for {
-		tokens := resp.NewDecoder(c.reader)
-		result, err := tokens.Decode()
-		if err != nil {
+		args, err := c.readCommand()
+		if errors.Is(err, resp.ErrLimitExceeded) || errors.Is(err, resp.ErrMalformed) {
+			// The rest of the request cannot be skipped reliably, so the
+			// connection is closed after the error.
+			reply := protocol.Error("ERR Protocol error: " + err.Error())
+			c.writer.WriteString(protocol.EncodeReply(reply, c.session.Proto))
 			return err
 		}
-
-		tks := lexer.ConvRESPToTokens(result)
-		val, err := c.engine.Protocol.ProcessCommand(tks)
-		tokenizedResponse := lexer.TokenizeCLI(val)
-		if err != nil {
-			if err := c.writeMessage("Error: " + err.Error() + "\n"); err != nil {
+		var reply protocol.Reply
+		var protocolErr *protocolError
+		switch {
+		case errors.As(err, &protocolErr):
+			reply = protocol.Error("ERR Protocol error: " + protocolErr.Error())
+		case err != nil:
+			return err
+		case len(args) > 0:
+			reply = c.protocol.ProcessCommand(c.session, args)
+		}
+		// An empty inline command gets no reply.
+		if reply != nil {
+			if _, err := c.writer.WriteString(protocol.EncodeReply(reply, c.session.Proto)); err != nil {
 				return err
 			}
-		} else {
-			if err := c.writeMessage(tokenizedResponse + "\n"); err != nil {
+		}
+		if c.reader.Buffered() == 0 {
+			if err := c.writer.Flush(); err != nil {
 				return err
 			}
 		}
 	}
 }
 
-func (c *Client) writeMessage(message string) error {
-	_, err := c.writer.WriteString(message)
+// protocolError is a malformed request that was read completely, so that
+// the connection can carry on with the next one.
+type protocolError struct {
+	err error
+}
+
+func (e *protocolError) Error() string { return e.err.Error() }
+
+// readCommand reads the next request, either a RESP array of bulk strings
+// or an inline command as typed into nc or telnet, and returns its
+// arguments, the first of which names the command. Arguments keep their
+// bytes unchanged, so they may contain whitespace, CRLF or NUL bytes.
+func (c *Client) readCommand() ([]string, error) {
+	inline, err := c.decoder.IsInline()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if inline {
+		args, err := c.decoder.DecodeInline()
+		if errors.Is(err, resp.ErrUnbalancedQuotes) {
+			return nil, &protocolError{err}
+		}
+		if err != nil {
+			return nil, err
+		}
+		return args, nil
+	}
+
+	result, err := c.decoder.Decode()
+	if err != nil {
+		return nil, err
+	}
+	if result.Type != resp.ARRAY || len(result.Array) == 0 {
+		return nil, &protocolError{errors.New("expected a non-empty array of bulk strings")}
+	}
+	args := make([]string, 0, len(result.Array))
+	for _, v := range result.Array {
+		if v.Type != resp.BULK_STRING || v.Null {
+			return nil, &protocolError{fmt.Errorf("expected bulk string, got %s", v.Type)}
+		}
+		args = append(args, v.String)
 	}
-	return c.writer.Flush()
+	return args, nil
 }
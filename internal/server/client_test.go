@@ -0,0 +1,609 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sebzz2k2/vaultic/internal/protocol"
+	"github.com/sebzz2k2/vaultic/internal/resp"
+	"github.com/sebzz2k2/vaultic/internal/storage"
+)
+
+// connect starts a client on one end of a pipe and returns a function that
+// sends a command from the other end and decodes the reply.
+func connect(t *testing.T) func(args ...string) *resp.RESPValue {
+	t.Helper()
+	engine, err := storage.NewStorageEngine(&storage.Config{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, peer := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		engine.Close()
+	})
+	go NewClient(peer, &Config{}, protocol.NewProtocol(engine)).Handle()
+	decoder := resp.NewDecoder(conn)
+
+	return func(args ...string) *resp.RESPValue {
+		t.Helper()
+		go conn.Write([]byte(resp.NewBuilder(false).Array(args).Build()))
+		reply, err := decoder.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+}
+
+func TestClientRoundTripsBinaryValues(t *testing.T) {
+	call := connect(t)
+
+	for _, tt := range []struct{ key, value string }{
+		{"json", `{"a": [1, 2], "b": "x y"}`},
+		{"url", "https://example.com/p?q=a b&r=%20#frag"},
+		{"crlf", "line one\r\nline two\r\n"},
+		{"key with spaces\x00", "nul\x00byte\xff\xfe"},
+		{"empty", ""},
+	} {
+		if reply := call("SET", tt.key, tt.value); reply.Type != resp.SIMPLE_STRING || reply.String != "OK" {
+			t.Fatalf("SET %q: unexpected reply %+v", tt.key, reply)
+		}
+		if reply := call("get", tt.key); reply.Type != resp.BULK_STRING || reply.String != tt.value {
+			t.Fatalf("GET %q = %q, want %q", tt.key, reply.String, tt.value)
+		}
+	}
+
+	if reply := call("NOPE", "x"); reply.Type != resp.ERROR || reply.Error != "ERR unknown command 'NOPE'" {
+		t.Fatalf("unknown command: unexpected reply %+v", reply)
+	}
+}
+
+func TestClientTypedReplies(t *testing.T) {
+	call := connect(t)
+
+	if reply := call("GET", "missing"); reply.Type != resp.BULK_STRING || !reply.Null {
+		t.Fatalf("RESP2 GET of a missing key: unexpected reply %+v", reply)
+	}
+	call("SET", "a", "1")
+	if reply := call("EXISTS", "a"); reply.Type != resp.INTEGER || reply.Int != 1 {
+		t.Fatalf("EXISTS: unexpected reply %+v", reply)
+	}
+	if reply := call("KEYS", "*"); reply.Type != resp.ARRAY || len(reply.Array) != 1 || reply.Array[0].String != "a" {
+		t.Fatalf("KEYS: unexpected reply %+v", reply)
+	}
+	if reply := call("DEL", "a"); reply.Type != resp.INTEGER || reply.Int != 1 {
+		t.Fatalf("DEL: unexpected reply %+v", reply)
+	}
+	if reply := call("DEL", "a"); reply.Type != resp.INTEGER || reply.Int != 0 {
+		t.Fatalf("DEL of a missing key: unexpected reply %+v", reply)
+	}
+	if reply := call("GET"); reply.Type != resp.ERROR || reply.Error != "ERR wrong number of arguments for 'get' command" {
+		t.Fatalf("GET without a key: unexpected reply %+v", reply)
+	}
+
+	if reply := call("HELLO", "4"); reply.Type != resp.ERROR || reply.Error != "NOPROTO unsupported protocol version" {
+		t.Fatalf("HELLO 4: unexpected reply %+v", reply)
+	}
+	reply := call("HELLO", "3", "SETNAME", "test")
+	if reply.Type != resp.MAP || reply.Map["proto"].Int != 3 || reply.Map["server"].String != "vaultic" {
+		t.Fatalf("HELLO 3: unexpected reply %+v", reply)
+	}
+	if reply := call("GET", "missing"); reply.Type != resp.NULL {
+		t.Fatalf("RESP3 GET of a missing key: unexpected reply %+v", reply)
+	}
+	if reply := call("HELLO", "2"); reply.Type != resp.ARRAY || len(reply.Array) != 12 {
+		t.Fatalf("HELLO 2: unexpected reply %+v", reply)
+	}
+}
+
+// countingConn counts the writes made to a connection.
+type countingConn struct {
+	net.Conn
+	writes atomic.Int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(b)
+}
+
+func TestClientPipelinesReplies(t *testing.T) {
+	engine, err := storage.NewStorageEngine(&storage.Config{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	counted := &countingConn{Conn: peer}
+	go NewClient(counted, &Config{}, protocol.NewProtocol(engine)).Handle()
+
+	const n = 200
+	b := resp.NewBuilder(false)
+	for i := 0; i < n; i++ {
+		b.Array([]string{"SET", fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)})
+		b.Array([]string{"GET", fmt.Sprintf("key-%d", i)})
+	}
+	go conn.Write([]byte(b.Build()))
+
+	decoder := resp.NewDecoder(conn)
+	for i := 0; i < n; i++ {
+		if reply, err := decoder.Decode(); err != nil || reply.String != "OK" {
+			t.Fatalf("reply %d to SET: %+v %v", i, reply, err)
+		}
+		if reply, err := decoder.Decode(); err != nil || reply.String != fmt.Sprintf("value-%d", i) {
+			t.Fatalf("reply %d to GET out of order: %+v %v", i, reply, err)
+		}
+	}
+	if writes := counted.writes.Load(); writes >= n {
+		t.Fatalf("%d pipelined commands took %d writes", 2*n, writes)
+	}
+}
+
+func TestClientClosesConnectionOverLimit(t *testing.T) {
+	engine, err := storage.NewStorageEngine(&storage.Config{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	done := make(chan error, 1)
+	go func() {
+		err := NewClient(peer, &Config{MaxMessageSize: 1024, MaxArrayLength: 16}, protocol.NewProtocol(engine)).Handle()
+		peer.Close()
+		done <- err
+	}()
+
+	go conn.Write([]byte("*2147483647\r\n"))
+	decoder := resp.NewDecoder(conn)
+	reply, err := decoder.Decode()
+	if err != nil || reply.Type != resp.ERROR || !strings.HasPrefix(reply.Error, "ERR Protocol error") {
+		t.Fatalf("unexpected reply %+v %v", reply, err)
+	}
+	if err := <-done; !errors.Is(err, resp.ErrLimitExceeded) {
+		t.Fatalf("client ended with %v", err)
+	}
+	if _, err := decoder.Decode(); err == nil {
+		t.Fatal("connection still open after the limit was exceeded")
+	}
+}
+
+func TestClientClosesConnectionOnMalformedRequest(t *testing.T) {
+	engine, err := storage.NewStorageEngine(&storage.Config{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	done := make(chan error, 1)
+	go func() {
+		err := NewClient(peer, &Config{}, protocol.NewProtocol(engine)).Handle()
+		peer.Close()
+		done <- err
+	}()
+
+	go conn.Write([]byte("*1\r\n$abc\r\n"))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if want := "-ERR Protocol error: malformed request: invalid bulk length \"abc\"\r\n"; err != nil || line != want {
+		t.Fatalf("got %q %v, want %q", line, err, want)
+	}
+	if err := <-done; !errors.Is(err, resp.ErrMalformed) {
+		t.Fatalf("client ended with %v", err)
+	}
+	if _, err := reader.ReadByte(); err == nil {
+		t.Fatal("connection still open after a malformed request")
+	}
+}
+
+func TestClientAcceptsInlineCommands(t *testing.T) {
+	engine, err := storage.NewStorageEngine(&storage.Config{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	go NewClient(peer, &Config{}, protocol.NewProtocol(engine)).Handle()
+
+	go conn.Write([]byte("SET greeting \"hello world\\r\\n\"\r\n\r\n" +
+		"*2\r\n$3\r\nGET\r\n$8\r\ngreeting\r\n" +
+		"SET broken \"quote\r\n" +
+		"get greeting\n"))
+
+	decoder := resp.NewDecoder(conn)
+	for _, want := range []string{"OK", "hello world\r\n", "ERR Protocol error: unbalanced quotes in request", "hello world\r\n"} {
+		reply, err := decoder.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := reply.String + reply.Error; got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestClientDescribesCommands(t *testing.T) {
+	call := connect(t)
+
+	count := call("COMMAND", "COUNT")
+	if count.Type != resp.INTEGER || count.Int < 8 {
+		t.Fatalf("COMMAND COUNT: unexpected reply %+v", count)
+	}
+	if all := call("COMMAND"); len(all.Array) != int(count.Int) {
+		t.Fatalf("COMMAND listed %d commands, COMMAND COUNT says %d", len(all.Array), count.Int)
+	}
+
+	info := call("COMMAND", "INFO", "set", "nope")
+	if len(info.Array) != 2 || !info.Array[1].Null {
+		t.Fatalf("COMMAND INFO: unexpected reply %+v", info)
+	}
+	set := info.Array[0].Array
+	if len(set) != 10 || set[0].String != "set" || set[1].Int != -3 ||
+		set[3].Int != 1 || set[4].Int != 1 || set[5].Int != 1 || set[2].Array[0].String != "write" {
+		t.Fatalf("COMMAND INFO set: unexpected reply %+v", set)
+	}
+
+	call("HELLO", "3")
+	docs := call("COMMAND", "DOCS", "get")
+	if docs.Type != resp.MAP || docs.Map["get"].Map["group"].String != "string" {
+		t.Fatalf("COMMAND DOCS: unexpected reply %+v", docs)
+	}
+	if reply := call("COMMAND", "FROB"); reply.Type != resp.ERROR {
+		t.Fatalf("unknown subcommand: unexpected reply %+v", reply)
+	}
+}
+
+func TestClientSetOptions(t *testing.T) {
+	call := connect(t)
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"SET", "k", "1", "XX"}, "<nil>"},
+		{[]string{"SET", "k", "1", "NX"}, "OK"},
+		{[]string{"SET", "k", "2", "NX"}, "<nil>"},
+		{[]string{"SET", "k", "2", "XX", "GET"}, "1"},
+		{[]string{"SET", "new", "1", "NX", "GET"}, "<nil>"},
+		{[]string{"SET", "k", "3", "ex", "100", "GET"}, "2"},
+		{[]string{"SET", "k", "4", "KEEPTTL"}, "OK"},
+		{[]string{"SET", "k", "5", "PXAT", "1", "GET"}, "4"},
+		{[]string{"SET", "k", "6", "NX", "EXAT", "9999999999"}, "OK"},
+		{[]string{"SET", "k", "7", "NX", "XX"}, "ERR syntax error"},
+		{[]string{"SET", "k", "7", "EX", "1", "PX", "1"}, "ERR syntax error"},
+		{[]string{"SET", "k", "7", "EX", "10", "KEEPTTL"}, "ERR syntax error"},
+		{[]string{"SET", "k", "7", "PXAT"}, "ERR syntax error"},
+		{[]string{"SET", "k", "7", "EX", "ten"}, "ERR value is not an integer or out of range"},
+		{[]string{"SET", "k", "7", "EX", "0"}, "ERR invalid expire time in 'set' command"},
+		{[]string{"SET", "k", "7", "EX", "9223372036854775807"}, "ERR invalid expire time in 'set' command"},
+		{[]string{"GET", "k"}, "6"},
+	} {
+		reply := call(tt.args...)
+		got := reply.String + reply.Error
+		if reply.Null {
+			got = "<nil>"
+		}
+		if got != tt.want {
+			t.Fatalf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestClientExpiry(t *testing.T) {
+	call := connect(t)
+
+	call("SET", "k", "v")
+	for _, tt := range []struct {
+		args []string
+		want int64
+	}{
+		{[]string{"TTL", "missing"}, -2},
+		{[]string{"TTL", "k"}, -1},
+		{[]string{"EXPIRE", "missing", "10"}, 0},
+		{[]string{"PERSIST", "k"}, 0},
+		{[]string{"EXPIRE", "k", "100"}, 1},
+		{[]string{"TTL", "k"}, 100},
+		{[]string{"PEXPIRE", "k", "5000"}, 1},
+		{[]string{"TTL", "k"}, 5},
+		{[]string{"PERSIST", "k"}, 1},
+		{[]string{"PTTL", "k"}, -1},
+		{[]string{"EXPIREAT", "k", "9999999999"}, 1},
+		{[]string{"PEXPIREAT", "k", "1"}, 1},
+		{[]string{"EXISTS", "k"}, 0},
+		{[]string{"TTL", "k"}, -2},
+	} {
+		if reply := call(tt.args...); reply.Type != resp.INTEGER || reply.Int != tt.want {
+			t.Fatalf("%v: unexpected reply %+v, want %d", tt.args, reply, tt.want)
+		}
+	}
+
+	call("SET", "k", "v", "PX", "100000")
+	if reply := call("PTTL", "k"); reply.Int <= 99000 || reply.Int > 100000 {
+		t.Fatalf("PTTL after SET PX: unexpected reply %+v", reply)
+	}
+	if reply := call("EXPIRE", "k", "-1"); reply.Int != 1 {
+		t.Fatalf("EXPIRE with a negative time: unexpected reply %+v", reply)
+	}
+	if reply := call("GET", "k"); !reply.Null {
+		t.Fatalf("key outlived EXPIRE with a negative time: %+v", reply)
+	}
+	if reply := call("EXPIRE", "k", "x"); reply.Error != "ERR value is not an integer or out of range" {
+		t.Fatalf("EXPIRE with a bad time: unexpected reply %+v", reply)
+	}
+	if reply := call("EXPIRE", "k", "9223372036854775807"); reply.Error != "ERR invalid expire time in 'expire' command" {
+		t.Fatalf("EXPIRE with an overflowing time: unexpected reply %+v", reply)
+	}
+}
+
+func TestClientScan(t *testing.T) {
+	call := connect(t)
+
+	for i := 0; i < 25; i++ {
+		call("SET", fmt.Sprintf("user:%02d", i), "v")
+		call("SET", fmt.Sprintf("order:%02d", i), "v")
+	}
+	// Clients parse cursors as unsigned 64-bit integers, however long the
+	// keys they resume from.
+	long := strings.Repeat("z", 300)
+	call("SET", long, "v")
+
+	scanAll := func(args ...string) []string {
+		t.Helper()
+		var keys []string
+		cursor := "0"
+		for {
+			reply := call(append([]string{"SCAN", cursor}, args...)...)
+			if reply.Type != resp.ARRAY || len(reply.Array) != 2 {
+				t.Fatalf("SCAN %s: unexpected reply %+v", cursor, reply)
+			}
+			for _, key := range reply.Array[1].Array {
+				keys = append(keys, key.String)
+			}
+			cursor = reply.Array[0].String
+			if _, err := strconv.ParseUint(cursor, 10, 64); err != nil {
+				t.Fatalf("SCAN returned cursor %q, which is not a uint64", cursor)
+			}
+			if cursor == "0" {
+				return keys
+			}
+		}
+	}
+
+	if keys := scanAll("COUNT", "1"); len(keys) != 51 || keys[50] != long {
+		t.Fatalf("SCAN returned %d keys, want 51", len(keys))
+	}
+	if keys := scanAll("MATCH", "user:1*", "COUNT", "3"); len(keys) != 10 || keys[0] != "user:10" {
+		t.Fatalf("SCAN MATCH returned %v", keys)
+	}
+	if keys := scanAll("TYPE", "string", "COUNT", "100"); len(keys) != 51 {
+		t.Fatalf("SCAN TYPE string returned %d keys, want 51", len(keys))
+	}
+	if keys := scanAll("TYPE", "hash"); len(keys) != 0 {
+		t.Fatalf("SCAN TYPE hash returned %v", keys)
+	}
+
+	// A cursor can be used more than once.
+	cursor := call("SCAN", "0", "COUNT", "5").Array[0].String
+	first, again := call("SCAN", cursor, "COUNT", "5"), call("SCAN", cursor, "COUNT", "5")
+	if first.Array[1].Array[0].String != "order:05" || again.Array[1].Array[0].String != "order:05" {
+		t.Fatalf("SCAN %s resumed at %+v and %+v, want order:05", cursor, first.Array[1], again.Array[1])
+	}
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"SCAN", "abc"}, "ERR invalid cursor"},
+		{[]string{"SCAN", "123456789"}, "ERR invalid cursor"},
+		{[]string{"SCAN", "0", "COUNT", "0"}, "ERR syntax error"},
+		{[]string{"SCAN", "0", "COUNT", "x"}, "ERR value is not an integer or out of range"},
+		{[]string{"SCAN", "0", "MATCH"}, "ERR syntax error"},
+		{[]string{"SCAN", "0", "LIMIT", "1"}, "ERR syntax error"},
+	} {
+		if reply := call(tt.args...); reply.Error != tt.want {
+			t.Fatalf("%v: unexpected reply %+v, want %q", tt.args, reply, tt.want)
+		}
+	}
+}
+
+func TestClientKeysPatternAndDBSize(t *testing.T) {
+	call := connect(t)
+
+	for _, key := range []string{"user:1", "user:2", "user:10", "users", "order:1", "h*llo", "hello"} {
+		call("SET", key, "v")
+	}
+	for pattern, want := range map[string]string{
+		"*":        "h*llo hello order:1 user:1 user:10 user:2 users",
+		"user:*":   "user:1 user:10 user:2",
+		"user:?":   "user:1 user:2",
+		"user*":    "user:1 user:10 user:2 users",
+		"*:1*":     "order:1 user:1 user:10",
+		"h[^*]llo": "hello",
+		`h\*llo`:   "h*llo",
+		"nope*":    "",
+	} {
+		reply := call("KEYS", pattern)
+		var got []string
+		for _, key := range reply.Array {
+			got = append(got, key.String)
+		}
+		if strings.Join(got, " ") != want {
+			t.Fatalf("KEYS %s = %v, want %s", pattern, got, want)
+		}
+	}
+
+	if reply := call("DBSIZE"); reply.Type != resp.INTEGER || reply.Int != 7 {
+		t.Fatalf("DBSIZE: unexpected reply %+v", reply)
+	}
+	call("DEL", "users")
+	if reply := call("DBSIZE"); reply.Int != 6 {
+		t.Fatalf("DBSIZE after DEL: unexpected reply %+v", reply)
+	}
+}
+
+func TestClientMultiKeyCommands(t *testing.T) {
+	call := connect(t)
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"MSET", "a", "1", "b", "2"}, "OK"},
+		{[]string{"MSET", "a", "1", "b"}, "ERR wrong number of arguments for 'mset' command"},
+		{[]string{"MSETNX", "b", "3", "c", "3"}, "0"},
+		{[]string{"MSETNX", "c", "3", "d", "4"}, "1"},
+		{[]string{"MGET", "a", "nope", "d"}, "1 <nil> 4"},
+		{[]string{"EXISTS", "a", "a", "nope"}, "2"},
+		{[]string{"DEL", "a", "a", "b", "nope"}, "2"},
+		{[]string{"MGET", "a", "b", "c"}, "<nil> <nil> 3"},
+	} {
+		reply := call(tt.args...)
+		got := reply.String + reply.Error
+		switch {
+		case reply.Type == resp.INTEGER:
+			got = fmt.Sprint(reply.Int)
+		case reply.Array != nil:
+			var values []string
+			for _, v := range reply.Array {
+				if v.Null {
+					values = append(values, "<nil>")
+				} else {
+					values = append(values, v.String)
+				}
+			}
+			got = strings.Join(values, " ")
+		}
+		if got != tt.want {
+			t.Fatalf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestClientCounters(t *testing.T) {
+	call := connect(t)
+
+	call("SET", "text", "abc")
+	call("SET", "max", "9223372036854775807")
+	call("SET", "maxfloat", "1.7976931348623157e308")
+	call("SET", "padded", "007")
+	call("SET", "huge", "1e300")
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"INCR", "n"}, "1"},
+		{[]string{"INCRBY", "n", "41"}, "42"},
+		{[]string{"DECR", "n"}, "41"},
+		{[]string{"DECRBY", "n", "-9"}, "50"},
+		{[]string{"GET", "n"}, "50"},
+		{[]string{"INCR", "text"}, "ERR value is not an integer or out of range"},
+		{[]string{"INCRBY", "n", "x"}, "ERR value is not an integer or out of range"},
+		{[]string{"INCRBY", "n", "+5"}, "ERR value is not an integer or out of range"},
+		{[]string{"INCRBY", "n", "010"}, "ERR value is not an integer or out of range"},
+		{[]string{"INCRBY", "n", "-0"}, "ERR value is not an integer or out of range"},
+		{[]string{"INCR", "padded"}, "ERR value is not an integer or out of range"},
+		{[]string{"INCR", "max"}, "ERR increment or decrement would overflow"},
+		{[]string{"DECRBY", "n", "-9223372036854775808"}, "ERR increment or decrement would overflow"},
+		{[]string{"INCRBYFLOAT", "f", "10.5"}, "10.5"},
+		{[]string{"INCRBYFLOAT", "f", "0.1"}, "10.6"},
+		{[]string{"INCRBYFLOAT", "f", "-5e0"}, "5.6"},
+		{[]string{"GET", "f"}, "5.6"},
+		{[]string{"INCRBYFLOAT", "text", "1"}, "ERR value is not a valid float"},
+		{[]string{"INCRBYFLOAT", "f", "inf"}, "ERR value is not a valid float"},
+		{[]string{"INCRBYFLOAT", "maxfloat", "1.7976931348623157e308"}, "ERR increment would produce NaN or Infinity"},
+		{[]string{"INCRBYFLOAT", "huge", "1e300"}, "2" + strings.Repeat("0", 300)},
+		{[]string{"INCRBYFLOAT", "small", "0.00001"}, "0.00001"},
+		{[]string{"INCRBYFLOAT", "million", "1000000"}, "1000000"},
+		{[]string{"INCR", "f"}, "ERR value is not an integer or out of range"},
+	} {
+		reply := call(tt.args...)
+		got := reply.String + reply.Error
+		if reply.Type == resp.INTEGER {
+			got = fmt.Sprint(reply.Int)
+		}
+		if got != tt.want {
+			t.Fatalf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+
+	call("HELLO", "3")
+	if reply := call("INCRBYFLOAT", "f", "1"); reply.Type != resp.DOUBLE || reply.Float != 6.6 {
+		t.Fatalf("INCRBYFLOAT under RESP3: unexpected reply %+v", reply)
+	}
+}
+
+func TestClientStringCommands(t *testing.T) {
+	call := connect(t)
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"APPEND", "s", "Hello"}, "5"},
+		{[]string{"APPEND", "s", " World"}, "11"},
+		{[]string{"STRLEN", "s"}, "11"},
+		{[]string{"STRLEN", "nope"}, "0"},
+		{[]string{"GETRANGE", "s", "0", "4"}, "Hello"},
+		{[]string{"GETRANGE", "s", "-5", "-1"}, "World"},
+		{[]string{"GETRANGE", "s", "-100", "100"}, "Hello World"},
+		{[]string{"GETRANGE", "s", "5", "3"}, ""},
+		{[]string{"GETRANGE", "s", "-1", "-5"}, ""},
+		{[]string{"GETRANGE", "nope", "0", "-1"}, ""},
+		{[]string{"GETRANGE", "s", "a", "1"}, "ERR value is not an integer or out of range"},
+		{[]string{"SETRANGE", "s", "6", "Redis"}, "11"},
+		{[]string{"GET", "s"}, "Hello Redis"},
+		{[]string{"SETRANGE", "pad", "3", "x"}, "4"},
+		{[]string{"GET", "pad"}, "\x00\x00\x00x"},
+		{[]string{"SETRANGE", "empty", "10", ""}, "0"},
+		{[]string{"EXISTS", "empty"}, "0"},
+		{[]string{"SETRANGE", "s", "-1", "x"}, "ERR offset is out of range"},
+		{[]string{"SETRANGE", "s", "536870911", "xy"}, "ERR string exceeds maximum allowed size (proto-max-bulk-len)"},
+		{[]string{"GETEX", "s", "EX", "100"}, "Hello Redis"},
+		{[]string{"TTL", "s"}, "100"},
+		{[]string{"GETEX", "s", "PERSIST"}, "Hello Redis"},
+		{[]string{"TTL", "s"}, "-1"},
+		{[]string{"GETEX", "s", "EX", "0"}, "ERR invalid expire time in 'getex' command"},
+		{[]string{"GETEX", "s", "PERSIST", "EX", "1"}, "ERR syntax error"},
+		{[]string{"GETEX", "s", "PXAT", "1"}, "Hello Redis"},
+		{[]string{"EXISTS", "s"}, "0"},
+		{[]string{"GETEX", "nope"}, "<nil>"},
+		{[]string{"GETDEL", "pad"}, "\x00\x00\x00x"},
+		{[]string{"GETDEL", "pad"}, "<nil>"},
+	} {
+		reply := call(tt.args...)
+		got := reply.String + reply.Error
+		switch {
+		case reply.Type == resp.INTEGER:
+			got = fmt.Sprint(reply.Int)
+		case reply.Null:
+			got = "<nil>"
+		}
+		if got != tt.want {
+			t.Fatalf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestClientInfoAcceptsSections(t *testing.T) {
+	call := connect(t)
+
+	all := call("INFO")
+	if all.Type != resp.BULK_STRING || !strings.Contains(all.String, "wal_recovered_records:") {
+		t.Fatalf("INFO: unexpected reply %+v", all)
+	}
+	for _, args := range [][]string{{"INFO", "server"}, {"INFO", "server", "stats"}, {"INFO", "everything"}} {
+		if reply := call(args...); reply.String != all.String {
+			t.Fatalf("%v: unexpected reply %+v", args, reply)
+		}
+	}
+}
@@ -9,13 +9,15 @@ import (
 	"time"
 
 	"github.com/rs/zerolog/log"
+	"github.com/sebzz2k2/vaultic/internal/protocol"
 	"github.com/sebzz2k2/vaultic/internal/storage"
 	"github.com/sebzz2k2/vaultic/pkg/utils"
 )
 
 type Server struct {
 	config   *Config
-	engine   storage.StorageEngine
+	engine   *storage.StorageEngine
+	protocol *protocol.Protocol
 	listener net.Listener
 
 	connections sync.Map
@@ -33,22 +35,35 @@ type Config struct {
 	WriteTimeout   time.Duration
 	MaxConnections int
 
-	MaxMessageSize int
+	// MaxMessageSize bounds the bytes of one request; MaxBulkLength,
+	// MaxArrayLength and MaxNestingDepth bound its parts. Zero means no
+	// limit. A client breaking a limit gets an error and is disconnected.
+	// Whichever of MaxMessageSize and MaxBulkLength is smaller caps the size
+	// of a value, so MaxMessageSize is kept above MaxBulkLength, which
+	// matches the 512 MB APPEND and SETRANGE build values up to.
+	MaxMessageSize  int
+	MaxBulkLength   int
+	MaxArrayLength  int
+	MaxNestingDepth int
 }
 
 func defaultConfig() *Config {
 	return &Config{
-		Address:        "localhost",
-		Port:           5381,
-		MaxConnections: 100,
-		MaxMessageSize: 1024 * 1024, // 1 MB
+		Address:         "localhost",
+		Port:            5381,
+		MaxConnections:  100,
+		MaxMessageSize:  1024 * 1024 * 1024, // 1 GB
+		MaxBulkLength:   512 * 1024 * 1024,  // 512 MB
+		MaxArrayLength:  1024 * 1024,
+		MaxNestingDepth: 8,
 	}
 }
 
-func New(cfg *Config, engine storage.StorageEngine) (*Server, error) {
+func New(cfg *Config, engine *storage.StorageEngine) (*Server, error) {
 	return &Server{
-		config: cfg,
-		engine: engine,
+		config:   cfg,
+		engine:   engine,
+		protocol: protocol.NewProtocol(engine),
 	}, nil
 }
 
@@ -103,7 +118,7 @@ func (s *Server) handleConnection(conn net.Conn) {
 		conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
 	}
 
-	client := NewClient(conn, s.config, s.engine)
+	client := NewClient(conn, s.config, s.protocol)
 
 	log.Info().
 		Str("remote_addr", conn.RemoteAddr().String()).
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sebzz2k2/vaultic/internal/wal"
+)
+
+// WriteBatch collects writes to several keys that Write applies atomically:
+// they are logged as one batch record, which recovery replays in full or not
+// at all, and they take consecutive sequence numbers. Writes to the same key
+// apply in the order they were added, so the last one wins.
+//
+// A WriteBatch is not safe for concurrent use.
+type WriteBatch struct {
+	ops []wal.BatchOp
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Put adds a write of value to key. Like Set it removes any expiry.
+func (b *WriteBatch) Put(key, value string) {
+	b.ops = append(b.ops, wal.BatchOp{Key: key, Value: value})
+}
+
+// PutWithExpiry adds a write of value to key that expires at the given time.
+// The zero time means never.
+func (b *WriteBatch) PutWithExpiry(key, value string, expireAt time.Time) {
+	op := wal.BatchOp{Key: key, Value: value}
+	if !expireAt.IsZero() {
+		// A time before 1970 has passed as well, and zero means never.
+		op.ExpireAt = uint64(max(expireAt.UnixMilli(), 1))
+	}
+	b.ops = append(b.ops, op)
+}
+
+// Delete adds a deletion of key. Deleting a key that does not exist is
+// allowed.
+func (b *WriteBatch) Delete(key string) {
+	b.ops = append(b.ops, wal.BatchOp{Key: key, Deleted: true})
+}
+
+// Len returns the number of writes in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Reset empties the batch so that it can be reused.
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// check returns an error if a write of the batch cannot be logged.
+func (b *WriteBatch) check() error {
+	for _, op := range b.ops {
+		if len(op.Key) > MaxKeySize {
+			return ErrKeyTooLarge
+		}
+	}
+	return nil
+}
+
+// Write applies the writes of b atomically. An empty batch writes nothing.
+// b can be reused once Write returns.
+func (se *StorageEngine) Write(b *WriteBatch) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	se.writeMu.Lock()
+	return se.writeLocked(b)
+}
+
+// writeLocked logs the writes of b as one batch record and applies them,
+// then releases writeMu through commitLocked. The caller must hold writeMu.
+func (se *StorageEngine) writeLocked(b *WriteBatch) error {
+	if b.Len() == 0 {
+		se.writeMu.Unlock()
+		return nil
+	}
+	ts := uint64(time.Now().Unix())
+	firstSeq := se.lastSeq + 1
+	rec, _ := se.wal.EncodeBatch(1, ts, firstSeq, b.ops)
+	end, err := se.wal.Append(rec)
+	if err != nil {
+		se.writeMu.Unlock()
+		return fmt.Errorf("Failed to write to WAL file: %w", err)
+	}
+
+	se.applyBatchLocked(ts, firstSeq, b.ops, end)
+	return se.commitLocked(end)
+}
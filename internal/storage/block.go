@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/sebzz2k2/vaultic/pkg/utils"
+)
+
+/*
+Every block in an SSTable (data, index and meta) shares one layout:
+
+	entry 0 ... entry N-1
+	4 bytes restart offset * R
+	4 bytes restart count R
+	4 bytes CRC over everything above (the block trailer)
+
+Each entry stores its key relative to the previous one:
+
+	uvarint shared key length
+	uvarint unshared key length
+	uvarint value length
+	<unshared> bytes key suffix
+	<value length> bytes value
+
+Every restartInterval entries the key is stored in full (shared = 0) and the
+entry's offset is recorded as a restart point, so a lookup can binary search
+the restart points before scanning forward.
+*/
+
+const (
+	blockTrailerSize     = 4
+	blockRestartInterval = 16
+)
+
+var ErrCorruption = errors.New("sstable corruption")
+
+type blockBuilder struct {
+	buf             []byte
+	restarts        []uint32
+	restartInterval int
+	counter         int
+	lastKey         []byte
+	entries         int
+}
+
+func newBlockBuilder(restartInterval int) *blockBuilder {
+	return &blockBuilder{
+		restartInterval: restartInterval,
+		restarts:        []uint32{0},
+	}
+}
+
+// add appends an entry. Keys must be added in strictly increasing order.
+func (b *blockBuilder) add(key, value []byte) {
+	shared := 0
+	if b.counter < b.restartInterval {
+		for shared < len(key) && shared < len(b.lastKey) && key[shared] == b.lastKey[shared] {
+			shared++
+		}
+	} else {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+		b.counter = 0
+	}
+
+	b.buf = binary.AppendUvarint(b.buf, uint64(shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(key)-shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(value)))
+	b.buf = append(b.buf, key[shared:]...)
+	b.buf = append(b.buf, value...)
+
+	b.lastKey = append(b.lastKey[:0], key...)
+	b.counter++
+	b.entries++
+}
+
+// estimatedSize is the size the block will have once finished, trailer
+// excluded.
+func (b *blockBuilder) estimatedSize() int {
+	return len(b.buf) + 4*len(b.restarts) + 4
+}
+
+func (b *blockBuilder) empty() bool {
+	return b.entries == 0
+}
+
+// finish appends the restart array and the checksum trailer and returns the
+// encoded block. The builder must be reset before it is reused.
+func (b *blockBuilder) finish() []byte {
+	for _, r := range b.restarts {
+		b.buf = binary.BigEndian.AppendUint32(b.buf, r)
+	}
+	b.buf = binary.BigEndian.AppendUint32(b.buf, uint32(len(b.restarts)))
+	b.buf = binary.BigEndian.AppendUint32(b.buf, utils.Crc32(string(b.buf)))
+	return b.buf
+}
+
+func (b *blockBuilder) reset() {
+	b.buf = b.buf[:0]
+	b.restarts = b.restarts[:1]
+	b.counter = 0
+	b.lastKey = b.lastKey[:0]
+	b.entries = 0
+}
+
+// block is a decoded, checksum-verified block.
+type block struct {
+	data     []byte // entries only
+	restarts []uint32
+}
+
+// decodeBlock verifies the trailer of raw, which includes it, and splits the
+// block into its entries and restart points. offset is only used to point
+// errors at the failing block.
+func decodeBlock(raw []byte, offset uint64) (*block, error) {
+	if len(raw) < 4+blockTrailerSize {
+		return nil, fmt.Errorf("%w: block at offset %d is truncated", ErrCorruption, offset)
+	}
+	body := raw[:len(raw)-blockTrailerSize]
+	crc := binary.BigEndian.Uint32(raw[len(raw)-blockTrailerSize:])
+	if utils.Crc32(string(body)) != crc {
+		return nil, fmt.Errorf("%w: checksum mismatch in block at offset %d", ErrCorruption, offset)
+	}
+
+	count := int(binary.BigEndian.Uint32(body[len(body)-4:]))
+	restartsStart := len(body) - 4 - 4*count
+	if count == 0 || restartsStart < 0 {
+		return nil, fmt.Errorf("%w: bad restart array in block at offset %d", ErrCorruption, offset)
+	}
+	restarts := make([]uint32, count)
+	for i := range restarts {
+		restarts[i] = binary.BigEndian.Uint32(body[restartsStart+4*i:])
+		if int(restarts[i]) > restartsStart {
+			return nil, fmt.Errorf("%w: bad restart point in block at offset %d", ErrCorruption, offset)
+		}
+	}
+	return &block{data: body[:restartsStart], restarts: restarts}, nil
+}
+
+// blockIterator walks the entries of a block in key order.
+type blockIterator struct {
+	b     *block
+	pos   int
+	key   []byte
+	value []byte
+	err   error
+}
+
+func (b *block) iterator() *blockIterator {
+	return &blockIterator{b: b}
+}
+
+// next advances to the following entry and makes it the current one. It
+// returns false at the end of the block or when an entry cannot be decoded,
+// in which case err is set.
+func (it *blockIterator) next() bool {
+	if it.err != nil || it.pos >= len(it.b.data) {
+		return false
+	}
+	data := it.b.data[it.pos:]
+	shared, n1 := binary.Uvarint(data)
+	unshared, n2 := binary.Uvarint(data[max(n1, 0):])
+	valueLen, n3 := binary.Uvarint(data[max(n1+n2, 0):])
+	if n1 <= 0 || n2 <= 0 || n3 <= 0 {
+		it.err = ErrCorruption
+		return false
+	}
+	header := n1 + n2 + n3
+	if shared > uint64(len(it.key)) || uint64(len(data)-header) < unshared+valueLen {
+		it.err = ErrCorruption
+		return false
+	}
+
+	it.key = append(it.key[:shared], data[header:header+int(unshared)]...)
+	it.value = data[header+int(unshared) : header+int(unshared+valueLen)]
+	it.pos += header + int(unshared+valueLen)
+	return true
+}
+
+// seek positions the iterator on the first entry with a key >= target and
+// returns false if there is no such entry.
+func (it *blockIterator) seek(target []byte) bool {
+	restarts := it.b.restarts
+	// Find the first restart point whose key is >= target; the entry we are
+	// looking for lies between the restart point before it and itself.
+	i := sort.Search(len(restarts), func(i int) bool {
+		probe := &blockIterator{b: it.b, pos: int(restarts[i])}
+		if !probe.next() {
+			return true
+		}
+		return bytes.Compare(probe.key, target) >= 0
+	})
+	if i > 0 {
+		i--
+	}
+
+	it.pos = int(restarts[i])
+	it.key = it.key[:0]
+	for it.next() {
+		if bytes.Compare(it.key, target) >= 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+)
+
+// bloomFilter is a Bloom filter over the keys of one SSTable. The encoded
+// form is the bit array followed by one byte holding the number of probes,
+// so a reader does not need to know the bits-per-key setting the table was
+// written with.
+type bloomFilter []byte
+
+func bloomHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// newBloomFilter builds a filter for the given key hashes using bitsPerKey
+// bits for every key.
+func newBloomFilter(hashes []uint32, bitsPerKey int) bloomFilter {
+	// k = bitsPerKey * ln(2) minimizes the false positive rate.
+	k := uint8(float64(bitsPerKey) * 0.69)
+	k = max(1, min(k, 30))
+
+	nBits := max(len(hashes)*bitsPerKey, 64)
+	nBytes := (nBits + 7) / 8
+	nBits = nBytes * 8
+
+	filter := make(bloomFilter, nBytes+1)
+	filter[nBytes] = k
+	for _, h := range hashes {
+		// Double hashing: derive the k probes from a single hash.
+		delta := h>>17 | h<<15
+		for i := uint8(0); i < k; i++ {
+			pos := h % uint32(nBits)
+			filter[pos/8] |= 1 << (pos % 8)
+			h += delta
+		}
+	}
+	return filter
+}
+
+// mayContain returns false only if key is definitely not in the table.
+func (f bloomFilter) mayContain(key string) bool {
+	if len(f) < 2 {
+		return true
+	}
+	nBits := uint32(len(f)-1) * 8
+	k := f[len(f)-1]
+	if k > 30 {
+		// Reserved for future encodings; treat as a match.
+		return true
+	}
+
+	h := bloomHash(key)
+	delta := h>>17 | h<<15
+	for i := uint8(0); i < k; i++ {
+		pos := h % nBits
+		if f[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+// FilterStats counts how the Bloom filters of SSTables answered lookups.
+//
+// Fields:
+//   - Checks: The number of lookups that consulted a filter.
+//   - Negatives: Lookups the filter rejected, skipping the data block read.
+//   - FalsePositives: Lookups the filter let through although the key was
+//     not in the table.
+type FilterStats struct {
+	Checks         uint64
+	Negatives      uint64
+	FalsePositives uint64
+}
+
+// FalsePositiveRate is the share of lookups for absent keys that the filters
+// failed to reject.
+func (s FilterStats) FalsePositiveRate() float64 {
+	if s.Negatives+s.FalsePositives == 0 {
+		return 0
+	}
+	return float64(s.FalsePositives) / float64(s.Negatives+s.FalsePositives)
+}
+
+type filterCounters struct {
+	checks         atomic.Uint64
+	negatives      atomic.Uint64
+	falsePositives atomic.Uint64
+}
+
+func (c *filterCounters) snapshot() FilterStats {
+	return FilterStats{
+		Checks:         c.checks.Load(),
+		Negatives:      c.negatives.Load(),
+		FalsePositives: c.falsePositives.Load(),
+	}
+}
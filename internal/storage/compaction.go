@@ -0,0 +1,413 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Names of the compaction strategies CompactionConfig.Strategy selects.
+const (
+	StrategyLeveled    = "leveled"
+	StrategySizeTiered = "size-tiered"
+)
+
+// CompactionConfig tunes the background compaction of SSTables.
+type CompactionConfig struct {
+	// Strategy selects how tables are picked for compaction, either
+	// StrategyLeveled or StrategySizeTiered. Empty means leveled.
+	Strategy string
+	// Concurrency is the number of compactions that may run at the same time.
+	Concurrency int
+	// RateLimit caps the bytes per second all compactions together may
+	// write. Zero means unlimited.
+	RateLimit int
+	// Leveled tunes the leveled strategy.
+	Leveled LeveledConfig
+	// SizeTiered tunes the size-tiered strategy.
+	SizeTiered SizeTieredConfig
+}
+
+func (c CompactionConfig) withDefaults() CompactionConfig {
+	if c.Strategy == "" {
+		c.Strategy = StrategyLeveled
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = 1
+	}
+	c.Leveled = c.Leveled.withDefaults()
+	c.SizeTiered = c.SizeTiered.withDefaults()
+	return c
+}
+
+// compactionStrategy decides which tables get compacted next.
+type compactionStrategy interface {
+	// pick returns the most urgent compaction of v that leaves the busy
+	// tables alone, or nil if there is nothing to do. It is called with the
+	// engine's mu held, so a strategy may keep state between calls.
+	pick(v *version, busy map[*SSTable]bool) *compaction
+}
+
+func newCompactionStrategy(cfg CompactionConfig) (compactionStrategy, error) {
+	switch cfg.Strategy {
+	case StrategyLeveled:
+		return &leveledStrategy{cfg: cfg.Leveled}, nil
+	case StrategySizeTiered:
+		return &sizeTieredStrategy{cfg: cfg.SizeTiered}, nil
+	default:
+		return nil, fmt.Errorf("unknown compaction strategy %q", cfg.Strategy)
+	}
+}
+
+// compaction merges the tables of inputs[0], taken from level, with the
+// tables of inputs[1], taken from output, into new tables of output.
+type compaction struct {
+	level  int
+	output int
+	inputs [2][]*SSTable
+	// base holds every table outside the inputs that may contain an older
+	// version of a key the inputs contain; a tombstone can only be dropped
+	// if none of them overlaps its key.
+	base [][]*SSTable
+	// maxOutputSize is the size at which the output is split into a new
+	// table. Zero writes a single table.
+	maxOutputSize int64
+}
+
+func (c *compaction) all() []*SSTable {
+	return append(append([]*SSTable{}, c.inputs[0]...), c.inputs[1]...)
+}
+
+func keyRange(tables []*SSTable) (string, string) {
+	minKey, maxKey := tables[0].MinKey, tables[0].MaxKey
+	for _, t := range tables[1:] {
+		minKey = min(minKey, t.MinKey)
+		maxKey = max(maxKey, t.MaxKey)
+	}
+	return minKey, maxKey
+}
+
+// isBaseLevelForKey reports whether no table outside the inputs may hold an
+// older version of key.
+func (c *compaction) isBaseLevelForKey(key string) bool {
+	for _, tables := range c.base {
+		for _, t := range tables {
+			if t.MinKey <= key && key <= t.MaxKey {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func anyBusy(tables []*SSTable, busy map[*SSTable]bool) bool {
+	for _, t := range tables {
+		if busy[t] {
+			return true
+		}
+	}
+	return false
+}
+
+// CompactionStats counts the table bytes written by flushes and compactions.
+//
+// Fields:
+//   - Flushes: The number of memtables written out as SSTables.
+//   - FlushedBytes: The bytes of SSTables written by flushes.
+//   - Compactions: The number of compactions finished.
+//   - CompactedBytesRead: The bytes of SSTables merged by compactions.
+//   - CompactedBytesWritten: The bytes of SSTables written by compactions.
+type CompactionStats struct {
+	Flushes               uint64
+	FlushedBytes          uint64
+	Compactions           uint64
+	CompactedBytesRead    uint64
+	CompactedBytesWritten uint64
+}
+
+// WriteAmplification is the number of table bytes written for every byte
+// flushed from a memtable: one for the flush itself plus whatever
+// compaction rewrote. It is zero before the first flush.
+func (s CompactionStats) WriteAmplification() float64 {
+	if s.FlushedBytes == 0 {
+		return 0
+	}
+	return float64(s.FlushedBytes+s.CompactedBytesWritten) / float64(s.FlushedBytes)
+}
+
+type compactionCounters struct {
+	flushes               atomic.Uint64
+	flushedBytes          atomic.Uint64
+	compactions           atomic.Uint64
+	compactedBytesRead    atomic.Uint64
+	compactedBytesWritten atomic.Uint64
+}
+
+func (c *compactionCounters) snapshot() CompactionStats {
+	return CompactionStats{
+		Flushes:               c.flushes.Load(),
+		FlushedBytes:          c.flushedBytes.Load(),
+		Compactions:           c.compactions.Load(),
+		CompactedBytesRead:    c.compactedBytesRead.Load(),
+		CompactedBytesWritten: c.compactedBytesWritten.Load(),
+	}
+}
+
+// CompactionStats returns the flush and compaction counters since the
+// engine was opened.
+func (se *StorageEngine) CompactionStats() CompactionStats {
+	return se.compactionStats.snapshot()
+}
+
+// compactLoop runs compactions on a background goroutine until the engine is
+// closed. Several loops may run at once, each picking a different
+// compaction.
+func (se *StorageEngine) compactLoop() {
+	defer se.wg.Done()
+	for {
+		select {
+		case <-se.compactCh:
+		case <-se.closeCh:
+			return
+		}
+
+		for {
+			select {
+			case <-se.closeCh:
+				return
+			default:
+			}
+
+			se.mu.Lock()
+			c := se.strategy.pick(se.current, se.compacting)
+			if c != nil {
+				for _, t := range c.all() {
+					se.compacting[t] = true
+				}
+			}
+			se.mu.Unlock()
+			if c == nil {
+				break
+			}
+
+			err := se.runCompaction(c)
+
+			se.mu.Lock()
+			for _, t := range c.all() {
+				delete(se.compacting, t)
+			}
+			se.mu.Unlock()
+
+			if err != nil {
+				log.Error().Err(err).Int("level", c.level).Msg("Compaction failed")
+				break
+			}
+			// Other loops may be waiting for the tables this one released.
+			se.scheduleCompaction()
+		}
+	}
+}
+
+func (se *StorageEngine) scheduleCompaction() {
+	for i := 0; i < se.config.Compaction.Concurrency; i++ {
+		select {
+		case se.compactCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// runCompaction merges the inputs, keeping only the newest version of every
+// key, turning expired values into tombstones and dropping tombstones that
+// no longer shadow anything, writes the
+// result as new tables of the output level and installs them in place of
+// the inputs.
+func (se *StorageEngine) runCompaction(c *compaction) error {
+	start := time.Now()
+
+	// Newest sources first: level 0 tables from the newest, then the upper
+	// level, then the lower one.
+	var sources []entryIterator
+	logEnd := int64(0)
+	bytesRead := int64(0)
+	for i := len(c.inputs[0]) - 1; i >= 0; i-- {
+		sources = append(sources, c.inputs[0][i].iterator())
+	}
+	for _, t := range c.inputs[1] {
+		sources = append(sources, t.iterator())
+	}
+	for _, t := range c.all() {
+		logEnd = max(logEnd, t.LogEnd)
+		bytesRead += t.Size
+	}
+	merged := newMergingIterator(sources...)
+	now := se.now()
+
+	var (
+		writers []*sstableWriter
+		w       *sstableWriter
+		lastKey string
+		started bool
+	)
+	abort := func(err error) error {
+		for _, w := range writers {
+			w.abort()
+		}
+		return err
+	}
+
+	for merged.next() {
+		e := merged.entry()
+		if started && e.Key == lastKey {
+			continue // an older version of a key already written
+		}
+		started, lastKey = true, e.Key
+		if !e.Deleted && !e.live(now) {
+			// An expired value still hides older versions, but no longer
+			// needs its value.
+			e = entry{Key: e.Key, Deleted: true, Seq: e.Seq, Ts: e.Ts}
+		}
+		if e.Deleted && c.isBaseLevelForKey(e.Key) {
+			continue
+		}
+
+		if w == nil {
+			var err error
+			w, err = newSSTableWriter(sstablePath(se.config.Dir, se.allocFileNum()), c.output, se.config.BlockSize, se.config.BloomBitsPerKey)
+			if err != nil {
+				return abort(err)
+			}
+			w.logEnd = logEnd
+			writers = append(writers, w)
+		}
+		if err := w.add(e); err != nil {
+			return abort(err)
+		}
+		se.limiter.wait(len(e.Key) + len(e.Value))
+
+		if c.maxOutputSize > 0 && int64(w.offset)+int64(w.data.estimatedSize()) >= c.maxOutputSize {
+			if err := w.seal(); err != nil {
+				return abort(err)
+			}
+			w = nil
+		}
+	}
+	if err := merged.err(); err != nil {
+		return abort(err)
+	}
+	if w != nil {
+		if err := w.seal(); err != nil {
+			return abort(err)
+		}
+	}
+
+	// Every output is complete and synced; only now do they get their final
+	// names, so a crash while writing leaves just temporary files behind.
+	var outputs []*SSTable
+	written := int64(0)
+	for _, w := range writers {
+		t, err := w.commit()
+		if err != nil {
+			for _, t := range outputs {
+				t.Close()
+			}
+			return err
+		}
+		outputs = append(outputs, t)
+		written += t.Size
+	}
+
+	if err := se.installVersion(&versionEdit{}, c.all(), outputs); err != nil {
+		for _, t := range outputs {
+			t.Close()
+			os.Remove(t.Path)
+		}
+		return err
+	}
+
+	se.compactionStats.compactions.Add(1)
+	se.compactionStats.compactedBytesRead.Add(uint64(bytesRead))
+	se.compactionStats.compactedBytesWritten.Add(uint64(written))
+
+	log.Info().
+		Str("strategy", se.config.Compaction.Strategy).
+		Int("level", c.level).
+		Int("output_level", c.output).
+		Int("inputs", len(c.inputs[0])+len(c.inputs[1])).
+		Int("outputs", len(outputs)).
+		Int64("bytes_read", bytesRead).
+		Int64("bytes_written", written).
+		Dur("took", time.Since(start)).
+		Msg("Compaction finished")
+	return nil
+}
+
+// installVersion records the edit, completed with the removed and added
+// tables, in the manifest and then atomically replaces the removed tables
+// with the added ones. Removed tables are deleted from disk once no reader
+// uses them anymore.
+func (se *StorageEngine) installVersion(edit *versionEdit, removed, added []*SSTable) error {
+	se.manifestMu.Lock()
+	defer se.manifestMu.Unlock()
+
+	for _, t := range removed {
+		edit.deleteTable(t)
+	}
+	for _, t := range added {
+		edit.addTable(t)
+	}
+	se.mu.RLock()
+	edit.setNextFileNum(se.nextFileNum)
+	se.mu.RUnlock()
+	if err := se.manifest.append(edit); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	se.mu.Lock()
+	old := se.current
+	se.current = newVersion(old.apply(removed, added))
+	for _, t := range removed {
+		t.obsolete.Store(true)
+	}
+	se.mu.Unlock()
+	old.unref()
+	return nil
+}
+
+// rateLimiter is a token bucket limiting the bytes per second written by
+// compactions, so that foreground writes keep most of the disk bandwidth.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int) *rateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(bytesPerSec), tokens: float64(bytesPerSec), last: time.Now()}
+}
+
+// wait blocks until n bytes may be written. A nil limiter never blocks.
+func (r *rateLimiter) wait(n int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	now := time.Now()
+	r.tokens = min(r.rate, r.tokens+now.Sub(r.last).Seconds()*r.rate)
+	r.last = now
+	r.tokens -= float64(n)
+	deficit := -r.tokens
+	r.mu.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / r.rate * float64(time.Second)))
+	}
+}
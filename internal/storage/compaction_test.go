@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// waitForCompactions blocks until nothing is left to flush or compact.
+func waitForCompactions(t *testing.T, se *StorageEngine) {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		se.mu.Lock()
+		idle := len(se.immutable) == 0 && len(se.compacting) == 0 && se.strategy.pick(se.current, se.compacting) == nil
+		se.mu.Unlock()
+		if idle {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("compactions did not settle")
+}
+
+// TestCompactionWriteAmplification runs the same overwrite-heavy workload
+// under every strategy and reports how many table bytes each wrote per byte
+// flushed.
+func TestCompactionWriteAmplification(t *testing.T) {
+	if testing.Short() {
+		t.Skip("write amplification harness is slow")
+	}
+
+	strategies := []CompactionConfig{
+		{
+			Strategy: StrategyLeveled,
+			Leveled:  LeveledConfig{L0Trigger: 4, LevelBaseSize: 16 * 1024, LevelMultiplier: 4, TargetFileSize: 4 * 1024},
+		},
+		{
+			Strategy:   StrategySizeTiered,
+			SizeTiered: SizeTieredConfig{MinThreshold: 4, MaxThreshold: 16, MinSSTableSize: 4 * 1024},
+		},
+	}
+
+	const keys, writes = 2000, 20000
+	amplification := map[string]float64{}
+	for _, cc := range strategies {
+		t.Run(cc.Strategy, func(t *testing.T) {
+			se, err := NewStorageEngine(&Config{Dir: t.TempDir(), WriteBufferSize: 4 * 1024, BlockSize: 1024, Compaction: cc})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer se.Close()
+
+			rng := rand.New(rand.NewSource(1))
+			want := map[string]string{}
+			for i := 0; i < writes; i++ {
+				key := fmt.Sprintf("key-%05d", rng.Intn(keys))
+				if rng.Intn(10) == 0 {
+					if _, err := se.Delete(key); err != nil {
+						t.Fatal(err)
+					}
+					delete(want, key)
+					continue
+				}
+				value := fmt.Sprintf("value-%d-%032d", i, i)
+				if err := se.Set(key, value); err != nil {
+					t.Fatal(err)
+				}
+				want[key] = value
+			}
+			waitForCompactions(t, se)
+
+			for i := 0; i < keys; i++ {
+				key := fmt.Sprintf("key-%05d", i)
+				val, found, err := se.Get(key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if exp, ok := want[key]; found != ok || val != exp {
+					t.Fatalf("%s = %q %v, want %q %v", key, val, found, exp, ok)
+				}
+			}
+
+			stats := se.CompactionStats()
+			if stats.Compactions == 0 {
+				t.Fatal("workload did not trigger any compaction")
+			}
+			amplification[cc.Strategy] = stats.WriteAmplification()
+			t.Logf("%s: %d flushes (%d bytes), %d compactions (%d bytes read, %d bytes written), write amplification %.2f",
+				cc.Strategy, stats.Flushes, stats.FlushedBytes, stats.Compactions,
+				stats.CompactedBytesRead, stats.CompactedBytesWritten, stats.WriteAmplification())
+		})
+	}
+
+	if amplification[StrategySizeTiered] >= amplification[StrategyLeveled] {
+		t.Errorf("size-tiered wrote %.2fx, expected less than leveled's %.2fx",
+			amplification[StrategySizeTiered], amplification[StrategyLeveled])
+	}
+}
+
+func TestSizeTieredBucketsSimilarSizes(t *testing.T) {
+	s := &sizeTieredStrategy{cfg: SizeTieredConfig{MinThreshold: 3, MaxThreshold: 4, MinSSTableSize: 100}.withDefaults()}
+
+	var tables []*SSTable
+	for i, size := range []int64{10, 20, 30, 1000, 1100, 1200, 900, 1050, 5000} {
+		tables = append(tables, &SSTable{FileNum: uint64(i + 1), Size: size, MaxSeq: uint64(i + 1)})
+	}
+	var levels [numLevels][]*SSTable
+	levels[0] = tables
+	v := &version{levels: levels}
+
+	c := s.pick(v, map[*SSTable]bool{})
+	if c == nil {
+		t.Fatal("expected a compaction")
+	}
+	if len(c.inputs[0]) != 4 {
+		t.Fatalf("expected MaxThreshold tables, got %d", len(c.inputs[0]))
+	}
+	for _, in := range c.inputs[0] {
+		if in.Size < 900 || in.Size > 1100 {
+			t.Fatalf("table of size %d does not belong in the bucket", in.Size)
+		}
+	}
+
+	busy := map[*SSTable]bool{}
+	for _, in := range c.inputs[0] {
+		busy[in] = true
+	}
+	if c := s.pick(v, busy); c == nil || len(c.inputs[0]) != 3 || c.inputs[0][0].Size >= 100 {
+		t.Fatalf("expected the small tables to be compacted next, got %+v", c)
+	}
+}
+
+func TestCompactionDropsExpiredValues(t *testing.T) {
+	se, err := NewStorageEngine(&Config{
+		Dir:             t.TempDir(),
+		WriteBufferSize: 1024,
+		ActiveExpiryHz:  -1,
+		Compaction:      CompactionConfig{Leveled: LeveledConfig{L0Trigger: 2}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer se.Close()
+
+	soon := time.Now().Add(100 * time.Millisecond)
+	for i := 0; i < 200; i++ {
+		opts := SetOptions{}
+		if i%2 == 0 {
+			opts.ExpireAt = soon
+		}
+		if _, err := se.SetWithOptions(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i), opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Until(soon))
+	// Overwriting the odd keys makes the tables holding the expired values
+	// overlap new ones, so they get compacted.
+	for i := 1; i < 200; i += 2 {
+		se.Set(fmt.Sprintf("key-%03d", i), "again")
+	}
+	waitForCompactions(t, se)
+
+	if se.CompactionStats().Compactions == 0 {
+		t.Fatal("workload did not trigger any compaction")
+	}
+	v := se.currentView()
+	defer v.release()
+	for level := 1; level < numLevels; level++ {
+		for _, table := range v.version.levels[level] {
+			it := table.iterator()
+			for it.next() {
+				if e := it.entry(); e.ExpireAt != 0 {
+					t.Fatalf("compacted table %s still holds expired %+v", table.Path, e)
+				}
+			}
+		}
+	}
+	if keys, _ := se.Keys(); len(keys) != 100 {
+		t.Fatalf("Keys returned %d keys, want 100", len(keys))
+	}
+}
@@ -1,41 +1,1114 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
 
-	"github.com/sebzz2k2/vaultic/internal/index"
-	"github.com/sebzz2k2/vaultic/internal/protocol"
 	"github.com/sebzz2k2/vaultic/internal/wal"
 )
 
+// Durability modes. With always every write is synced before it is
+// acknowledged. Group does the same, but concurrent writers share one sync.
+// Everysec acknowledges writes right away and syncs once a second, so a
+// crash may lose the last second of writes.
+const (
+	DurabilityAlways   = "always"
+	DurabilityGroup    = "group"
+	DurabilityEverySec = "everysec"
+)
+
+const defaultWriteBufferSize = 4 * 1024 * 1024
+
+// MaxKeySize is the length in bytes of the longest key the write-ahead log
+// can hold. Keys and values are otherwise arbitrary byte strings.
+const MaxKeySize = math.MaxUint16
+
+var ErrKeyTooLarge = errors.New("key too large")
+
+type Config struct {
+	// Dir holds the write-ahead log and the SSTables.
+	Dir string
+	// WriteBufferSize is the size in bytes a memtable may reach before it is
+	// frozen and flushed to an SSTable.
+	WriteBufferSize int
+	// BlockSize is the target size in bytes of SSTable data blocks.
+	BlockSize int
+	// BloomBitsPerKey is the number of Bloom filter bits spent on every key
+	// of an SSTable. Zero disables the filters.
+	BloomBitsPerKey int
+	// Durability selects when writes reach the disk: DurabilityAlways,
+	// DurabilityGroup or DurabilityEverySec. Empty means always.
+	Durability string
+	// WALSegmentSize is the size in bytes a write-ahead log segment may
+	// reach before the log rolls over to a new one.
+	WALSegmentSize int64
+	// WALRecovery is the wal.RecoveryPolicy applied to damaged log records
+	// found on startup. Empty means truncate.
+	WALRecovery string
+	// ActiveExpiryHz is how many times a second active expiry looks for
+	// expired keys to delete. Zero means 10; a negative value disables
+	// active expiry, leaving expired keys to compaction.
+	ActiveExpiryHz int
+	// Compaction tunes the background compaction of SSTables.
+	Compaction CompactionConfig
+	// Now returns the time keys are checked for expiry against. Nil means
+	// time.Now.
+	Now func() time.Time
+}
+
 type StorageEngine struct {
-	idx      *index.Index
-	Protocol *protocol.Protocol
+	config   *Config
 	wal      *wal.WAL
+	recovery wal.RecoveryReport
+
+	// writeMu serializes writers so that log order and memtable order agree.
+	writeMu sync.Mutex
+	lastSeq uint64
+
+	// expiring indexes the keys that have an expiry, for active expiry.
+	expiring *expiryIndex
+	// now returns the current time in Unix milliseconds, the unit expiries
+	// are stored in.
+	now func() uint64
+
+	// manifestMu orders version edits, so that the manifest and the
+	// installed versions see them in the same order.
+	manifestMu sync.Mutex
+
+	// mu guards the memtables, the current version and the compaction state.
+	mu          sync.RWMutex
+	memtable    *memTable
+	immutable   []*memTable // frozen memtables waiting to be flushed, oldest first
+	current     *version
+	manifest    *manifest
+	nextFileNum uint64
+	compacting  map[*SSTable]bool
+	strategy    compactionStrategy
+	limiter     *rateLimiter
+
+	compactionStats compactionCounters
+
+	flushCh   chan struct{}
+	compactCh chan struct{}
+	closeCh   chan struct{}
+	wg        sync.WaitGroup
+}
+
+func NewStorageEngine(config *Config) (*StorageEngine, error) {
+	cfg := *config
+	if cfg.WriteBufferSize <= 0 {
+		cfg.WriteBufferSize = defaultWriteBufferSize
+	}
+	if cfg.ActiveExpiryHz == 0 {
+		cfg.ActiveExpiryHz = defaultActiveExpiryHz
+	}
+	cfg.Compaction = cfg.Compaction.withDefaults()
+	switch cfg.Durability {
+	case "":
+		cfg.Durability = DurabilityAlways
+	case DurabilityAlways, DurabilityGroup, DurabilityEverySec:
+	default:
+		return nil, fmt.Errorf("unknown durability mode %q", cfg.Durability)
+	}
+	recovery, err := wal.ParseRecoveryPolicy(cfg.WALRecovery)
+	if err != nil {
+		return nil, err
+	}
+	cfg.WALRecovery = string(recovery)
+	strategy, err := newCompactionStrategy(cfg.Compaction)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	state, found, err := readManifest(cfg.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	var levels [numLevels][]*SSTable
+	if found {
+		levels, err = openLevels(cfg.Dir, state)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open sstables: %w", err)
+		}
+	} else {
+		// The directory predates the manifest, so whatever tables are on
+		// disk are taken to be live.
+		tables, err := loadSSTables(cfg.Dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load sstables: %w", err)
+		}
+		levels = buildLevels(tables)
+		state = newManifestState()
+	}
+
+	clock := cfg.Now
+	if clock == nil {
+		clock = time.Now
+	}
+	se := &StorageEngine{
+		config:      &cfg,
+		expiring:    newExpiryIndex(),
+		now:         func() uint64 { return uint64(clock().UnixMilli()) },
+		current:     newVersion(levels),
+		nextFileNum: 1,
+		compacting:  map[*SSTable]bool{},
+		strategy:    strategy,
+		limiter:     newRateLimiter(cfg.Compaction.RateLimit),
+		flushCh:     make(chan struct{}, 1),
+		compactCh:   make(chan struct{}, cfg.Compaction.Concurrency),
+		closeCh:     make(chan struct{}),
+	}
+
+	replayFrom := state.logEnd
+	se.lastSeq = state.lastSeq
+	se.nextFileNum = max(se.nextFileNum, state.nextFileNum)
+	for _, t := range se.current.tables() {
+		replayFrom = max(replayFrom, t.LogEnd)
+		se.lastSeq = max(se.lastSeq, t.MaxSeq)
+		se.nextFileNum = max(se.nextFileNum, t.FileNum+1)
+	}
+	se.memtable = newMemTable(replayFrom)
+
+	// Every start writes a fresh manifest holding just the live state, which
+	// keeps the manifest from growing without bound.
+	manifestNum := se.nextFileNum
+	se.nextFileNum++
+	snapshot := newManifestState()
+	snapshot.lastSeq = se.lastSeq
+	snapshot.nextFileNum = se.nextFileNum
+	snapshot.logEnd = replayFrom
+	for _, t := range se.current.tables() {
+		snapshot.files[t.FileNum] = fileMeta{level: t.Level, num: t.FileNum, size: t.Size}
+	}
+	se.manifest, err = createManifest(cfg.Dir, manifestNum, snapshot)
+	if err != nil {
+		se.current.unref()
+		return nil, fmt.Errorf("failed to write manifest: %w", err)
+	}
+	removeObsoleteFiles(cfg.Dir, se.current.levels, se.manifest.name)
+
+	se.wal, err = wal.NewWAL(cfg.Dir, cfg.WALSegmentSize)
+	if err != nil {
+		se.manifest.close()
+		se.current.unref()
+		return nil, fmt.Errorf("failed to open write-ahead log: %w", err)
+	}
+
+	se.wg.Add(1 + cfg.Compaction.Concurrency)
+	go se.flushLoop()
+	if cfg.Durability == DurabilityEverySec {
+		se.wg.Add(1)
+		go se.syncLoop()
+	}
+	for i := 0; i < cfg.Compaction.Concurrency; i++ {
+		go se.compactLoop()
+	}
+	se.scheduleCompaction()
+
+	log.Info().
+		Int("sstables", len(se.current.tables())).
+		Int64("offset", replayFrom).
+		Msg("Replaying write-ahead log into memtable")
+	if err := se.replayLog(replayFrom, recovery); err != nil {
+		se.Close()
+		return nil, fmt.Errorf("failed to replay write-ahead log: %w", err)
+	}
+	event := log.Info()
+	if se.recovery.DroppedRecords > 0 {
+		event = log.Warn()
+	}
+	event.
+		Str("policy", cfg.WALRecovery).
+		Int64("records", se.recovery.Records).
+		Int64("dropped_records", se.recovery.DroppedRecords).
+		Int64("dropped_bytes", se.recovery.DroppedBytes).
+		Int("torn_tails", se.recovery.TornTails).
+		Msg("Recovered write-ahead log")
+	if err := se.wal.Purge(replayFrom); err != nil {
+		log.Error().Err(err).Msg("Failed to remove flushed WAL segments")
+	}
+
+	if cfg.ActiveExpiryHz > 0 {
+		se.wg.Add(1)
+		go se.expiryLoop()
+	}
+	return se, nil
+}
+
+// buildLevels sorts the tables found in a directory without a manifest into
+// their levels. There, a crash after a compaction has committed its output
+// but before its inputs were removed leaves both on disk; the inputs are
+// recognised and deleted here.
+// In levels 1 and deeper a table overlapping a newer one of the same level
+// was replaced by it. A level 0 table holding nothing newer than what has
+// already moved to deeper levels was compacted into them, since every table
+// flushed after a compaction started is newer than all of its inputs.
+func buildLevels(tables []*SSTable) [numLevels][]*SSTable {
+	var levels [numLevels][]*SSTable
+	for _, t := range tables {
+		if t.Level < 0 || t.Level >= numLevels {
+			log.Warn().Str("table", t.Path).Int("level", t.Level).Msg("Ignoring sstable with unknown level")
+			t.Close()
+			continue
+		}
+		levels[t.Level] = append(levels[t.Level], t)
+	}
+
+	stale := func(t *SSTable, newer *SSTable) {
+		log.Warn().
+			Str("table", t.Path).
+			Str("replaced_by", newer.Path).
+			Msg("Removing sstable left behind by an interrupted compaction")
+		t.Close()
+		os.Remove(t.Path)
+	}
+
+	deepMaxSeq, deepest := uint64(0), (*SSTable)(nil)
+	for level := 1; level < numLevels; level++ {
+		// Newest first, so the table that survives an overlap is the newer.
+		tables := levels[level]
+		sort.Slice(tables, func(i, j int) bool { return tables[i].FileNum > tables[j].FileNum })
+		var kept []*SSTable
+		for _, t := range tables {
+			if newer := overlapping(kept, t.MinKey, t.MaxKey); len(newer) > 0 {
+				stale(t, newer[0])
+				continue
+			}
+			kept = append(kept, t)
+			if deepest == nil || t.MaxSeq > deepMaxSeq {
+				deepMaxSeq, deepest = t.MaxSeq, t
+			}
+		}
+		levels[level] = kept
+	}
+
+	var l0 []*SSTable
+	for _, t := range levels[0] {
+		if deepest != nil && t.MaxSeq <= deepMaxSeq {
+			stale(t, deepest)
+			continue
+		}
+		l0 = append(l0, t)
+	}
+	levels[0] = l0
+
+	sortLevels(&levels)
+	return levels
+}
+
+// replayLog re-inserts every record written to the log after offset into the
+// memtable. Records before offset are already contained in an SSTable.
+// Damaged records are handled according to policy.
+func (se *StorageEngine) replayLog(offset int64, policy wal.RecoveryPolicy) error {
+	se.writeMu.Lock()
+	defer se.writeMu.Unlock()
+
+	var err error
+	se.recovery, err = se.wal.Replay(offset, policy, func(entry map[string]interface{}, end int64) error {
+		if ops, ok := entry["ops"].([]wal.BatchOp); ok {
+			se.applyBatchLocked(entry["ts"].(uint64), entry["firstSeq"].(uint64), ops, end)
+			return nil
+		}
+		flags := entry["flags"].(map[string]interface{})
+		se.applyLocked(entry["ts"].(uint64), entry["expireAt"].(uint64), flags["deleted"].(bool), entry["key"].(string), entry["val"].(string), end)
+		return nil
+	})
+	return err
+}
+
+// applyLocked assigns the next sequence number to a record, inserts it into
+// the active memtable and freezes the memtable once it outgrows the write
+// buffer. logEnd is the log position just past the record. The caller must
+// hold writeMu.
+func (se *StorageEngine) applyLocked(ts, expireAt uint64, deleted bool, key, value string, logEnd int64) {
+	se.insertLocked(ts, expireAt, deleted, key, value)
+	se.endRecordLocked(logEnd)
+}
+
+// applyBatchLocked applies the ops of a batch record like applyLocked,
+// numbering them from firstSeq on unless that would reuse sequence numbers.
+// The memtable is only frozen after the last op, so that a batch never
+// spans two memtables. The caller must hold writeMu.
+func (se *StorageEngine) applyBatchLocked(ts, firstSeq uint64, ops []wal.BatchOp, logEnd int64) {
+	if firstSeq > 0 {
+		se.lastSeq = max(se.lastSeq, firstSeq-1)
+	}
+	for _, op := range ops {
+		se.insertLocked(ts, op.ExpireAt, op.Deleted, op.Key, op.Value)
+	}
+	se.endRecordLocked(logEnd)
+}
+
+// insertLocked assigns the next sequence number to a write and inserts it
+// into the active memtable. The caller must hold writeMu.
+func (se *StorageEngine) insertLocked(ts, expireAt uint64, deleted bool, key, value string) {
+	se.lastSeq++
+	se.memtable.list.InsertSeq(se.lastSeq, ts, expireAt, deleted, key, value)
+	se.expiring.note(key, expireAt)
+}
+
+// endRecordLocked notes that the active memtable holds the log up to logEnd
+// and freezes it once it outgrows the write buffer. The caller must hold
+// writeMu.
+func (se *StorageEngine) endRecordLocked(logEnd int64) {
+	mem := se.memtable
+	mem.logEnd = logEnd
+
+	if mem.list.SizeInBytes() < se.config.WriteBufferSize {
+		return
+	}
+
+	se.mu.Lock()
+	se.immutable = append(se.immutable, mem)
+	se.memtable = newMemTable(logEnd)
+	se.mu.Unlock()
+
+	// Start the records of the new memtable in a segment of their own, so
+	// that the segments behind it can be deleted as soon as it is flushed.
+	if _, err := se.wal.Rotate(); err != nil {
+		log.Error().Err(err).Msg("Failed to rotate write-ahead log")
+	}
+
+	select {
+	case se.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+// flushLoop writes frozen memtables out as SSTables in the background.
+func (se *StorageEngine) flushLoop() {
+	defer se.wg.Done()
+	for {
+		select {
+		case <-se.flushCh:
+			se.flushImmutable()
+		case <-se.closeCh:
+			se.flushImmutable()
+			return
+		}
+	}
+}
+
+// flushImmutable flushes frozen memtables, oldest first, until none are left
+// or a flush fails. A failed memtable stays frozen and is retried on the next
+// signal; its records are still in the log.
+func (se *StorageEngine) flushImmutable() {
+	for {
+		se.mu.RLock()
+		if len(se.immutable) == 0 {
+			se.mu.RUnlock()
+			return
+		}
+		mem := se.immutable[0]
+		se.mu.RUnlock()
+
+		num := se.allocFileNum()
+		start := time.Now()
+		table, err := writeSSTable(sstablePath(se.config.Dir, num), se.config.BlockSize, se.config.BloomBitsPerKey, mem)
+		if err != nil {
+			log.Error().Err(err).Uint64("file", num).Msg("Failed to flush memtable")
+			return
+		}
+
+		edit := &versionEdit{}
+		edit.setLastSeq(table.MaxSeq)
+		edit.setLogEnd(mem.logEnd)
+		if err := se.installVersion(edit, nil, []*SSTable{table}); err != nil {
+			log.Error().Err(err).Uint64("file", num).Msg("Failed to record flushed sstable")
+			table.Close()
+			os.Remove(table.Path)
+			return
+		}
+
+		// Until the memtable is dropped its records are in both places,
+		// which readers do not mind.
+		se.mu.Lock()
+		se.immutable = se.immutable[1:]
+		se.mu.Unlock()
+		se.compactionStats.flushes.Add(1)
+		se.compactionStats.flushedBytes.Add(uint64(table.Size))
+		se.scheduleCompaction()
+
+		if err := se.wal.Purge(mem.logEnd); err != nil {
+			log.Error().Err(err).Msg("Failed to remove flushed WAL segments")
+		}
+
+		log.Info().
+			Uint64("file", num).
+			Int("entries", mem.list.GetLength()).
+			Int64("bytes", table.Size).
+			Dur("took", time.Since(start)).
+			Msg("Flushed memtable to sstable")
+	}
+}
+
+// allocFileNum reserves the number of a new table file.
+func (se *StorageEngine) allocFileNum() uint64 {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	num := se.nextFileNum
+	se.nextFileNum++
+	return num
+}
+
+// view is a consistent snapshot of where data lives. Every record is in
+// exactly one of the memtables or SSTables of a view, so a read going
+// through a view never misses a record that is being flushed.
+// The view holds a reference on its version, which must be given back with
+// release.
+type view struct {
+	memtable  *memTable
+	immutable []*memTable // oldest first
+	version   *version
+}
+
+func (se *StorageEngine) currentView() view {
+	se.mu.RLock()
+	defer se.mu.RUnlock()
+	se.current.ref()
+	return view{
+		memtable:  se.memtable,
+		immutable: se.immutable,
+		version:   se.current,
+	}
+}
+
+func (v view) release() {
+	v.version.unref()
+}
+
+// lookup finds the newest version of key. It consults the active memtable,
+// then the frozen memtables and finally the SSTables, newest first, and
+// stops at the first hit. A tombstone is a hit, so it hides older versions.
+func (se *StorageEngine) lookup(key string) (entry, bool, error) {
+	v := se.currentView()
+	defer v.release()
+	return v.lookup(key)
+}
+
+// lookup finds the newest version of key in v.
+func (v view) lookup(key string) (entry, bool, error) {
+	e, found, err := v.find(key)
+	if err != nil || !found {
+		return e, found, err
+	}
+	return e, true, e.load()
+}
+
+// find looks key up like lookup, but leaves a separate value unread. It
+// can be read as long as v is held.
+func (v view) find(key string) (entry, bool, error) {
+	if e, found := v.memtable.get(key); found {
+		return e, true, nil
+	}
+	for i := len(v.immutable) - 1; i >= 0; i-- {
+		if e, found := v.immutable[i].get(key); found {
+			return e, true, nil
+		}
+	}
+	return v.version.find(key)
+}
+
+// lookupLive finds the live version of key, treating tombstones and expired
+// values as missing.
+func (se *StorageEngine) lookupLive(key string) (entry, bool, error) {
+	e, found, err := se.lookup(key)
+	if err != nil || !found || !e.live(se.now()) {
+		return entry{}, false, err
+	}
+	return e, true, nil
+}
+
+func (se *StorageEngine) Get(key string) (string, bool, error) {
+	e, found, err := se.lookupLive(key)
+	if err != nil || !found {
+		return "", false, err
+	}
+	return e.Value, true, nil
+}
+
+// GetRange reads part of the value of key. span is given the size of the
+// value and returns the bytes to read, from included to to excluded, which
+// must lie within the value. Of a value stored separately in an SSTable only
+// the chunks holding those bytes are read.
+func (se *StorageEngine) GetRange(key string, span func(size int) (from, to int)) (string, bool, error) {
+	v := se.currentView()
+	defer v.release()
+
+	e, found, err := v.find(key)
+	if err != nil || !found || !e.live(se.now()) {
+		return "", false, err
+	}
+	from, to := span(e.valueSize())
+	value, err := e.valueRange(from, to)
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// commitLocked releases writeMu once the record ending at end is as durable
+// as the configured mode demands. In group mode the sync happens after
+// releasing writeMu, so writers arriving meanwhile append their records and
+// share the next sync. The caller must hold writeMu.
+func (se *StorageEngine) commitLocked(end int64) error {
+	var err error
+	switch se.config.Durability {
+	case DurabilityAlways:
+		err = se.wal.SyncTo(end)
+		se.writeMu.Unlock()
+	case DurabilityGroup:
+		se.writeMu.Unlock()
+		err = se.wal.SyncTo(end)
+	default:
+		se.writeMu.Unlock()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to sync write-ahead log: %w", err)
+	}
+	return nil
+}
+
+// syncLoop syncs the log once a second in everysec mode.
+func (se *StorageEngine) syncLoop() {
+	defer se.wg.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := se.wal.Sync(); err != nil {
+				log.Error().Err(err).Msg("Failed to sync write-ahead log")
+			}
+		case <-se.closeCh:
+			return
+		}
+	}
+}
+
+func (se *StorageEngine) Set(key, value string) error {
+	if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	se.writeMu.Lock()
+	return se.putLocked(key, value, 0)
+}
+
+// SetOptions qualify a write made with SetWithOptions.
+//
+// Fields:
+//   - ExpireAt: When the key expires. The zero time means never.
+//   - KeepTTL: Keep the expiry the key already has, ignoring ExpireAt.
+//   - IfAbsent: Only write if the key does not exist.
+//   - IfPresent: Only write if the key exists.
+type SetOptions struct {
+	ExpireAt  time.Time
+	KeepTTL   bool
+	IfAbsent  bool
+	IfPresent bool
+}
+
+// SetResult is the outcome of SetWithOptions.
+//
+// Fields:
+//   - Old: The value the key held before the write, if Existed.
+//   - Existed: Whether the key existed before the write.
+//   - Written: Whether the value was written. It is only false when the
+//     condition of the options did not hold.
+type SetResult struct {
+	Old     string
+	Existed bool
+	Written bool
+}
+
+// SetWithOptions writes value to key if the condition of opts holds and
+// reports what the key held before. The check and the write are atomic with
+// respect to other writers. An expired key counts as absent.
+func (se *StorageEngine) SetWithOptions(key, value string, opts SetOptions) (SetResult, error) {
+	if len(key) > MaxKeySize {
+		return SetResult{}, ErrKeyTooLarge
+	}
+	se.writeMu.Lock()
+
+	old, found, err := se.lookupLive(key)
+	if err != nil {
+		se.writeMu.Unlock()
+		return SetResult{}, err
+	}
+	result := SetResult{Old: old.Value, Existed: found}
+	if (opts.IfAbsent && found) || (opts.IfPresent && !found) {
+		se.writeMu.Unlock()
+		return result, nil
+	}
+
+	var expireAt uint64
+	switch {
+	case opts.KeepTTL:
+		expireAt = old.ExpireAt
+	case !opts.ExpireAt.IsZero():
+		// A time before 1970 has passed as well, and zero means never.
+		expireAt = uint64(max(opts.ExpireAt.UnixMilli(), 1))
+	}
+	result.Written = true
+	return result, se.putLocked(key, value, expireAt)
+}
+
+// Update atomically replaces the value of key with the one fn returns for
+// the current value and whether the key exists. No other write to the store
+// happens between the read and the write. If fn returns an error nothing is
+// written and Update returns it. The key keeps its expiry. Update returns
+// the value written.
+func (se *StorageEngine) Update(key string, fn func(value string, found bool) (string, error)) (string, error) {
+	if len(key) > MaxKeySize {
+		return "", ErrKeyTooLarge
+	}
+	se.writeMu.Lock()
+
+	old, found, err := se.lookupLive(key)
+	if err != nil {
+		se.writeMu.Unlock()
+		return "", err
+	}
+	value, err := fn(old.Value, found)
+	if err != nil {
+		se.writeMu.Unlock()
+		return "", err
+	}
+	return value, se.putLocked(key, value, old.ExpireAt)
+}
+
+// putLocked logs and applies a write of value to key that expires at
+// expireAt, zero meaning never, then releases writeMu through commitLocked.
+// The caller must hold writeMu.
+func (se *StorageEngine) putLocked(key, value string, expireAt uint64) error {
+	ts := uint64(time.Now().Unix())
+	rec, _ := se.wal.EncodeExpiringWAL(1, false, ts, false, key, value, expireAt)
+	end, err := se.wal.Append(rec)
+	if err != nil {
+		se.writeMu.Unlock()
+		return err
+	}
+
+	se.applyLocked(ts, expireAt, false, key, value, end)
+	return se.commitLocked(end)
 }
 
-func NewStorageEngine() (*StorageEngine, error) {
-	wal := wal.NewWAL()
-	idx := index.NewIndex("vaultic", wal)
+func (se *StorageEngine) Delete(key string) (bool, error) {
+	se.writeMu.Lock()
+
+	found, err := se.Exists(key)
+	if err != nil || !found {
+		se.writeMu.Unlock()
+		return false, err
+	}
+	return true, se.deleteLocked(key)
+}
 
-	log.Info().Msg("Building indexes")
-	if err := idx.BuildIndexes(); err != nil {
-		return nil, fmt.Errorf("failed to build indexes: %w", err)
+// deleteLocked logs and applies a tombstone for key, then releases writeMu
+// through commitLocked. The caller must hold writeMu.
+func (se *StorageEngine) deleteLocked(key string) error {
+	ts := uint64(time.Now().Unix())
+	rec, _ := se.wal.EncodeWAL(1, true, ts, false, key, "")
+	end, err := se.wal.Append(rec)
+	if err != nil {
+		se.writeMu.Unlock()
+		return fmt.Errorf("Failed to write to WAL file: %w", err)
 	}
-	log.Info().Msg("Indexes built successfully")
 
-	return &StorageEngine{
-		wal:      wal,
-		idx:      idx,
-		Protocol: protocol.NewProtocol(wal),
-	}, nil
+	se.applyLocked(ts, 0, true, key, "", end)
+	return se.commitLocked(end)
+}
+
+// Expire makes key expire at the given time and reports whether the key
+// exists. The value is written again along with its new expiry. A time that
+// has already passed deletes the key.
+func (se *StorageEngine) Expire(key string, at time.Time) (bool, error) {
+	se.writeMu.Lock()
+
+	e, found, err := se.lookupLive(key)
+	if err != nil || !found {
+		se.writeMu.Unlock()
+		return false, err
+	}
+	expireAt := at.UnixMilli()
+	if expireAt <= int64(se.now()) {
+		return true, se.deleteLocked(key)
+	}
+	return true, se.putLocked(key, e.Value, uint64(expireAt))
+}
+
+// Persist removes the expiry of key and reports whether it had one.
+func (se *StorageEngine) Persist(key string) (bool, error) {
+	se.writeMu.Lock()
+
+	e, found, err := se.lookupLive(key)
+	if err != nil || !found || e.ExpireAt == 0 {
+		se.writeMu.Unlock()
+		return false, err
+	}
+	return true, se.putLocked(key, e.Value, 0)
+}
+
+// GetDel atomically reads and deletes key. It reports the value the key
+// held and whether it existed.
+func (se *StorageEngine) GetDel(key string) (string, bool, error) {
+	se.writeMu.Lock()
+
+	e, found, err := se.lookupLive(key)
+	if err != nil || !found {
+		se.writeMu.Unlock()
+		return "", false, err
+	}
+	return e.Value, true, se.deleteLocked(key)
+}
+
+// GetExOptions change the expiry of a key read with GetEx.
+//
+// Fields:
+//   - ExpireAt: When the key expires from now on. The zero time leaves the
+//     expiry alone, and a time that has passed deletes the key.
+//   - Persist: Remove the expiry of the key, ignoring ExpireAt.
+type GetExOptions struct {
+	ExpireAt time.Time
+	Persist  bool
+}
+
+// GetEx atomically reads key and changes its expiry as opts say. It reports
+// the value the key held and whether it existed.
+func (se *StorageEngine) GetEx(key string, opts GetExOptions) (string, bool, error) {
+	se.writeMu.Lock()
+
+	e, found, err := se.lookupLive(key)
+	if err != nil || !found {
+		se.writeMu.Unlock()
+		return "", false, err
+	}
+	switch {
+	case opts.Persist && e.ExpireAt != 0:
+		return e.Value, true, se.putLocked(key, e.Value, 0)
+	case opts.Persist || opts.ExpireAt.IsZero():
+		se.writeMu.Unlock()
+		return e.Value, true, nil
+	}
+	expireAt := opts.ExpireAt.UnixMilli()
+	if expireAt <= int64(se.now()) {
+		return e.Value, true, se.deleteLocked(key)
+	}
+	return e.Value, true, se.putLocked(key, e.Value, uint64(expireAt))
+}
+
+// ExpireTime reports when key expires, the zero time if it does not, and
+// whether the key exists.
+func (se *StorageEngine) ExpireTime(key string) (time.Time, bool, error) {
+	e, found, err := se.lookupLive(key)
+	if err != nil || !found || e.ExpireAt == 0 {
+		return time.Time{}, found, err
+	}
+	return time.UnixMilli(int64(e.ExpireAt)), true, nil
 }
 
-func (se *StorageEngine) Get()           {}
-func (se *StorageEngine) Set()           {}
-func (se *StorageEngine) Delete()        {}
-func (se *StorageEngine) Exists() bool   { return false }
-func (se *StorageEngine) Keys() []string { return []string{} }
-func (se *StorageEngine) Close() error   { return nil }
+func (se *StorageEngine) Exists(key string) (bool, error) {
+	_, found, err := se.lookupLive(key)
+	return found, err
+}
+
+// KeyValue is a key and the value to write to it.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// GetMany reads several keys at once, from the same view. found[i] reports
+// whether keys[i] exists, and values[i] holds its value if it does.
+func (se *StorageEngine) GetMany(keys []string) (values []string, found []bool, err error) {
+	v := se.currentView()
+	defer v.release()
+
+	now := se.now()
+	values, found = make([]string, len(keys)), make([]bool, len(keys))
+	for i, key := range keys {
+		e, ok, err := v.lookup(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok && e.live(now) {
+			values[i], found[i] = e.Value, true
+		}
+	}
+	return values, found, nil
+}
+
+// SetMany writes several keys in one WriteBatch, so that a crash leaves
+// either all of them written or none. Like Set it removes any expiry. With
+// ifNoneExist nothing is written if any of the keys exists; it reports
+// whether the keys were written. A key given twice gets its last value.
+func (se *StorageEngine) SetMany(pairs []KeyValue, ifNoneExist bool) (bool, error) {
+	b := NewWriteBatch()
+	for _, kv := range pairs {
+		b.Put(kv.Key, kv.Value)
+	}
+	if err := b.check(); err != nil {
+		return false, err
+	}
+	se.writeMu.Lock()
+
+	if ifNoneExist {
+		for _, kv := range pairs {
+			_, found, err := se.lookupLive(kv.Key)
+			if err != nil || found {
+				se.writeMu.Unlock()
+				return false, err
+			}
+		}
+	}
+	return true, se.writeLocked(b)
+}
+
+// DeleteMany deletes several keys in one WriteBatch and returns how many of
+// them existed. A key given twice counts once.
+func (se *StorageEngine) DeleteMany(keys []string) (int, error) {
+	se.writeMu.Lock()
+
+	b := NewWriteBatch()
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		_, found, err := se.lookupLive(key)
+		if err != nil {
+			se.writeMu.Unlock()
+			return 0, err
+		}
+		if found {
+			b.Delete(key)
+		}
+	}
+	return b.Len(), se.writeLocked(b)
+}
+
+// CountExisting returns how many of keys exist, reading them from the same
+// view. A key given twice counts twice.
+func (se *StorageEngine) CountExisting(keys []string) (int, error) {
+	v := se.currentView()
+	defer v.release()
+
+	now := se.now()
+	n := 0
+	for _, key := range keys {
+		e, found, err := v.lookup(key)
+		if err != nil {
+			return 0, err
+		}
+		if found && e.live(now) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// iterators returns iterators over the entries of v with a key >= start,
+// newest source first as newMergingIterator expects. With keysOnly the
+// entries read from SSTables come without their values.
+func (v view) iterators(start string, keysOnly bool) []entryIterator {
+	sources := []entryIterator{v.memtable.iteratorFrom(start)}
+	for i := len(v.immutable) - 1; i >= 0; i-- {
+		sources = append(sources, v.immutable[i].iteratorFrom(start))
+	}
+	table := func(t *SSTable) entryIterator {
+		it := t.iteratorFrom(start)
+		it.keysOnly = keysOnly
+		return it
+	}
+	l0 := v.version.levels[0]
+	for i := len(l0) - 1; i >= 0; i-- {
+		sources = append(sources, table(l0[i]))
+	}
+	for level := 1; level < numLevels; level++ {
+		for _, t := range v.version.levels[level] {
+			if t.MaxKey >= start {
+				sources = append(sources, table(t))
+			}
+		}
+	}
+	return sources
+}
+
+// walkLive calls fn with the keys of v from start on that are live at now,
+// in order, until fn returns false. All sources are merged and the newest
+// version of each key decides whether it is live, so keys that are deleted
+// or expired are left out. Values are not needed and not copied out of
+// SSTables.
+func (v view) walkLive(start string, now uint64, fn func(key string) bool) error {
+	it := newMergingIterator(v.iterators(start, true)...)
+	last, started := "", false
+	for it.next() {
+		e := it.entry()
+		if started && e.Key == last {
+			continue
+		}
+		started, last = true, e.Key
+		if e.live(now) && !fn(e.Key) {
+			break
+		}
+	}
+	return it.err()
+}
+
+// Keys returns every live key in sorted order.
+func (se *StorageEngine) Keys() ([]string, error) {
+	return se.KeysWithPrefix("", nil)
+}
+
+// KeysWithPrefix returns the live keys starting with prefix that match
+// accepts, or all of them if match is nil, in sorted order. Only the range
+// of keys starting with prefix is read.
+func (se *StorageEngine) KeysWithPrefix(prefix string, match func(key string) bool) ([]string, error) {
+	v := se.currentView()
+	defer v.release()
+
+	keys := []string{}
+	err := v.walkLive(prefix, se.now(), func(key string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		if match == nil || match(key) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// KeyCount returns the number of live keys. It merges the keys of all
+// sources like Keys, but neither copies values nor collects the keys.
+func (se *StorageEngine) KeyCount() (int, error) {
+	v := se.currentView()
+	defer v.release()
+
+	n := 0
+	err := v.walkLive("", se.now(), func(string) bool {
+		n++
+		return true
+	})
+	return n, err
+}
+
+// Scan walks up to count live keys in order, from start on, and returns
+// those match accepts, or all of them if match is nil. next is the key the
+// following call should start from, or empty once every key has been
+// walked. Since keys are walked in order, a scan resumed from next returns
+// every key that exists throughout the scan exactly once, whatever is
+// written in between.
+func (se *StorageEngine) Scan(start string, count int, match func(key string) bool) (keys []string, next string, err error) {
+	v := se.currentView()
+	defer v.release()
+
+	keys = []string{}
+	walked := 0
+	err = v.walkLive(start, se.now(), func(key string) bool {
+		if walked == count {
+			next = key
+			return false
+		}
+		walked++
+		if match == nil || match(key) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return keys, next, nil
+}
+
+// Info describes the configuration and state of the engine as name and value
+// pairs.
+func (se *StorageEngine) Info() map[string]string {
+	filters := se.FilterStats()
+	compactions := se.CompactionStats()
+
+	se.mu.RLock()
+	tables := len(se.current.tables())
+	memtableBytes := se.memtable.list.SizeInBytes()
+	immutable := len(se.immutable)
+	se.mu.RUnlock()
+
+	return map[string]string{
+		"durability":                se.config.Durability,
+		"wal_syncs":                 strconv.FormatUint(se.wal.Syncs(), 10),
+		"wal_recovery":              se.config.WALRecovery,
+		"wal_recovered_records":     strconv.FormatInt(se.recovery.Records, 10),
+		"wal_dropped_records":       strconv.FormatInt(se.recovery.DroppedRecords, 10),
+		"wal_dropped_bytes":         strconv.FormatInt(se.recovery.DroppedBytes, 10),
+		"expiring_keys":             strconv.Itoa(se.expiring.len()),
+		"expired_keys":              strconv.FormatUint(se.expiring.expired.Load(), 10),
+		"compaction_strategy":       se.config.Compaction.Strategy,
+		"sstables":                  strconv.Itoa(tables),
+		"memtable_bytes":            strconv.Itoa(memtableBytes),
+		"immutable_memtables":       strconv.Itoa(immutable),
+		"flushes":                   strconv.FormatUint(compactions.Flushes, 10),
+		"compactions":               strconv.FormatUint(compactions.Compactions, 10),
+		"write_amplification":       strconv.FormatFloat(compactions.WriteAmplification(), 'f', 2, 64),
+		"bloom_checks":              strconv.FormatUint(filters.Checks, 10),
+		"bloom_negatives":           strconv.FormatUint(filters.Negatives, 10),
+		"bloom_false_positives":     strconv.FormatUint(filters.FalsePositives, 10),
+		"bloom_false_positive_rate": strconv.FormatFloat(filters.FalsePositiveRate(), 'f', 4, 64),
+	}
+}
+
+// FilterStats sums the Bloom filter counters of all live SSTables.
+func (se *StorageEngine) FilterStats() FilterStats {
+	se.mu.RLock()
+	defer se.mu.RUnlock()
+
+	var total FilterStats
+	for _, t := range se.current.tables() {
+		s := t.FilterStats()
+		total.Checks += s.Checks
+		total.Negatives += s.Negatives
+		total.FalsePositives += s.FalsePositives
+	}
+	return total
+}
+
+// Close waits for frozen memtables to be flushed and for running compactions
+// to finish. The active memtable is not flushed; its records are replayed
+// from the log on the next start.
+func (se *StorageEngine) Close() error {
+	select {
+	case <-se.closeCh:
+		return nil
+	default:
+	}
+	close(se.closeCh)
+	se.wg.Wait()
+
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	se.current.unref()
+	se.current = newVersion([numLevels][]*SSTable{})
+	if err := se.wal.Close(); err != nil {
+		se.manifest.close()
+		return err
+	}
+	return se.manifest.close()
+}
@@ -0,0 +1,700 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sebzz2k2/vaultic/internal/wal"
+)
+
+func openTestEngine(t *testing.T, dir string) *StorageEngine {
+	t.Helper()
+	se, err := NewStorageEngine(&Config{Dir: dir, WriteBufferSize: 512})
+	if err != nil {
+		t.Fatalf("failed to open engine: %v", err)
+	}
+	return se
+}
+
+func TestEngineFlushesMemtable(t *testing.T) {
+	dir := t.TempDir()
+	se := openTestEngine(t, dir)
+
+	for i := 0; i < 100; i++ {
+		if err := se.Set(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatalf("set failed: %v", err)
+		}
+	}
+	if _, err := se.Delete("key-010"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	se.Close()
+
+	tables, err := loadSSTables(dir)
+	if err != nil {
+		t.Fatalf("failed to load sstables: %v", err)
+	}
+	if len(tables) == 0 {
+		t.Fatal("expected the memtable to be flushed to at least one sstable")
+	}
+	flushed := int64(0)
+	for _, table := range tables {
+		flushed = max(flushed, table.LogEnd)
+		table.Close()
+	}
+
+	se = openTestEngine(t, dir)
+	defer se.Close()
+
+	if se.memtable.logEnd < flushed {
+		t.Fatalf("replay started before the flushed prefix of the log")
+	}
+	val, found, err := se.Get("key-042")
+	if err != nil || !found || val != "value-42" {
+		t.Fatalf("unexpected value after reopen: %q %v %v", val, found, err)
+	}
+	if _, found, _ := se.Get("key-010"); found {
+		t.Fatal("deleted key is visible after reopen")
+	}
+}
+
+func TestEngineReadsNeverSeeAGapDuringFlush(t *testing.T) {
+	se := openTestEngine(t, t.TempDir())
+	defer se.Close()
+
+	const n = 2000
+	var written atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			if err := se.Set(fmt.Sprintf("key-%05d", i), "v"); err != nil {
+				t.Errorf("set failed: %v", err)
+				return
+			}
+			written.Store(int64(i + 1))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for written.Load() < n {
+			last := written.Load()
+			if last == 0 {
+				continue
+			}
+			key := fmt.Sprintf("key-%05d", last-1)
+			if _, found, err := se.Get(key); err != nil || !found {
+				t.Errorf("%s not visible: found=%v err=%v", key, found, err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestEngineTombstoneHidesFlushedValue(t *testing.T) {
+	se := openTestEngine(t, t.TempDir())
+	defer se.Close()
+
+	se.Set("shadowed", "old")
+	for i := 0; i < 50; i++ {
+		se.Set(fmt.Sprintf("filler-%02d", i), "xxxxxxxxxxxxxxxx")
+	}
+	if found, _ := se.Delete("shadowed"); !found {
+		t.Fatal("expected the key to exist before deleting it")
+	}
+	if _, found, _ := se.Get("shadowed"); found {
+		t.Fatal("tombstone in the memtable should hide the flushed value")
+	}
+	keys, err := se.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		if k == "shadowed" {
+			t.Fatal("deleted key listed by Keys")
+		}
+	}
+	if len(keys) != 50 {
+		t.Fatalf("expected 50 keys, got %d", len(keys))
+	}
+}
+
+func TestEngineGetRangeReadsOnlyTheRange(t *testing.T) {
+	dir := t.TempDir()
+	se := openTestEngine(t, dir)
+
+	big := strings.Repeat("abcdefghij", 100*1024)
+	if err := se.Set("big", big); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+	if err := se.Set("small", "hello world"); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+	span := func(from, to int) func(int) (int, int) {
+		return func(int) (int, int) { return from, to }
+	}
+	if part, found, err := se.GetRange("small", span(6, 11)); err != nil || !found || part != "world" {
+		t.Fatalf("unexpected range of a memtable value: %q %v %v", part, found, err)
+	}
+	se.Close()
+
+	// Damage the last chunk of the flushed value. A range before it must
+	// still be readable, which it is only if the chunk is not read.
+	se = openTestEngine(t, dir)
+	v := se.currentView()
+	e, found, err := v.find("big")
+	v.release()
+	if err != nil || !found || e.ref.size != uint64(len(big)) {
+		t.Fatalf("expected big to be stored separately: %v %v", found, err)
+	}
+	path := e.ref.table.Path
+	se.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[e.ref.offset+e.ref.size-1] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	se = openTestEngine(t, dir)
+	defer se.Close()
+	var size int
+	part, found, err := se.GetRange("big", func(n int) (int, int) {
+		size = n
+		return 5000, 5010
+	})
+	if err != nil || !found || part != big[5000:5010] || size != len(big) {
+		t.Fatalf("unexpected range of a flushed value: %q %v %v (size %d)", part, found, err, size)
+	}
+	if _, _, err := se.Get("big"); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("reading the whole value should hit the damaged chunk, got %v", err)
+	}
+	if _, found, err := se.GetRange("missing", span(0, 0)); found || err != nil {
+		t.Fatalf("unexpected range of a missing key: %v %v", found, err)
+	}
+}
+
+func TestEngineCompactsIntoSortedLevels(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{
+		Dir:             dir,
+		WriteBufferSize: 512,
+		BlockSize:       256,
+		Compaction: CompactionConfig{
+			Concurrency: 2,
+			Leveled: LeveledConfig{
+				L0Trigger:      2,
+				LevelBaseSize:  4 * 1024,
+				TargetFileSize: 1024,
+			},
+		},
+	}
+	se, err := NewStorageEngine(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 600
+	for round := 0; round < 3; round++ {
+		for i := 0; i < n; i++ {
+			if err := se.Set(fmt.Sprintf("key-%04d", i), fmt.Sprintf("value-%d-%d", round, i)); err != nil {
+				t.Fatalf("set failed: %v", err)
+			}
+		}
+	}
+	for i := 0; i < n; i += 7 {
+		if _, err := se.Delete(fmt.Sprintf("key-%04d", i)); err != nil {
+			t.Fatalf("delete failed: %v", err)
+		}
+	}
+	waitForCompactions(t, se)
+	se.Close()
+
+	se, err = NewStorageEngine(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer se.Close()
+
+	se.mu.RLock()
+	levels := se.current.levels
+	se.mu.RUnlock()
+	deep := 0
+	for level := 1; level < numLevels; level++ {
+		tables := levels[level]
+		deep += len(tables)
+		for i := 1; i < len(tables); i++ {
+			if tables[i].MinKey <= tables[i-1].MaxKey {
+				t.Fatalf("level %d tables %d and %d overlap", level, tables[i-1].FileNum, tables[i].FileNum)
+			}
+		}
+	}
+	if deep == 0 {
+		t.Fatal("expected tables to be compacted out of level 0")
+	}
+
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		val, found, err := se.Get(key)
+		if err != nil {
+			t.Fatalf("get %s: %v", key, err)
+		}
+		if i%7 == 0 {
+			if found {
+				t.Fatalf("deleted key %s is visible", key)
+			}
+			continue
+		}
+		if want := fmt.Sprintf("value-2-%d", i); !found || val != want {
+			t.Fatalf("%s = %q %v, want %q", key, val, found, want)
+		}
+	}
+	keys, err := se.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := n - (n+6)/7; len(keys) != want {
+		t.Fatalf("expected %d keys, got %d", want, len(keys))
+	}
+}
+
+func TestEngineRemovesFlushedWALSegments(t *testing.T) {
+	dir := t.TempDir()
+	se := openTestEngine(t, dir)
+	for i := 0; i < 500; i++ {
+		if err := se.Set(fmt.Sprintf("key-%04d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForCompactions(t, se)
+	se.Close()
+
+	segments, err := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) > 2 {
+		t.Fatalf("flushed segments were kept: %v", segments)
+	}
+
+	se = openTestEngine(t, dir)
+	defer se.Close()
+	for i := 0; i < 500; i++ {
+		if _, found, _ := se.Get(fmt.Sprintf("key-%04d", i)); !found {
+			t.Fatalf("key-%04d lost", i)
+		}
+	}
+}
+
+func TestEngineDurabilityModes(t *testing.T) {
+	const writers, perWriter = 16, 20
+
+	syncs := map[string]uint64{}
+	for _, mode := range []string{DurabilityAlways, DurabilityGroup, DurabilityEverySec} {
+		t.Run(mode, func(t *testing.T) {
+			se, err := NewStorageEngine(&Config{Dir: t.TempDir(), Durability: mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer se.Close()
+
+			var wg sync.WaitGroup
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < perWriter; i++ {
+						if err := se.Set(fmt.Sprintf("key-%d-%d", w, i), "value"); err != nil {
+							t.Errorf("set failed: %v", err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			syncs[mode] = se.wal.Syncs()
+			if got := se.Info()["durability"]; got != mode {
+				t.Fatalf("info reports durability %q", got)
+			}
+		})
+	}
+
+	if syncs[DurabilityAlways] != writers*perWriter {
+		t.Errorf("always synced %d times for %d writes", syncs[DurabilityAlways], writers*perWriter)
+	}
+	if syncs[DurabilityGroup] == 0 || syncs[DurabilityGroup] > writers*perWriter {
+		t.Errorf("group commit synced %d times for %d writes", syncs[DurabilityGroup], writers*perWriter)
+	}
+	if syncs[DurabilityEverySec] != 0 {
+		t.Errorf("everysec synced on the write path %d times", syncs[DurabilityEverySec])
+	}
+
+	if _, err := NewStorageEngine(&Config{Dir: t.TempDir(), Durability: "sometimes"}); err == nil {
+		t.Error("expected an unknown durability mode to be rejected")
+	}
+}
+
+func TestEngineStartsAfterTornWALAppend(t *testing.T) {
+	dir := t.TempDir()
+	se, err := NewStorageEngine(&Config{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := se.Set(fmt.Sprintf("key-%02d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	se.Close()
+
+	// Power loss half way through appending one more record.
+	segments, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	var last string
+	for _, path := range segments {
+		if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+			last = path
+		}
+	}
+	rec, _ := (&wal.WAL{}).EncodeWAL(1, false, 1, false, "torn", "value")
+	f, err := os.OpenFile(last, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(rec[:len(rec)-3])
+	f.Close()
+
+	se, err = NewStorageEngine(&Config{Dir: dir, WALRecovery: string(wal.RecoverFail)})
+	if err != nil {
+		t.Fatalf("torn append stopped the engine from starting: %v", err)
+	}
+	defer se.Close()
+	for i := 0; i < 50; i++ {
+		if _, found, _ := se.Get(fmt.Sprintf("key-%02d", i)); !found {
+			t.Fatalf("key-%02d lost", i)
+		}
+	}
+	if _, found, _ := se.Get("torn"); found {
+		t.Fatal("torn record was replayed")
+	}
+	info := se.Info()
+	if info["wal_recovered_records"] != "50" || info["wal_dropped_records"] != "1" {
+		t.Fatalf("unexpected recovery report: %v", info)
+	}
+}
+
+func TestEngineSetWithOptions(t *testing.T) {
+	dir := t.TempDir()
+	se := openTestEngine(t, dir)
+
+	if r, err := se.SetWithOptions("k", "1", SetOptions{IfPresent: true}); err != nil || r.Written || r.Existed {
+		t.Fatalf("XX on a missing key: %+v %v", r, err)
+	}
+	if r, err := se.SetWithOptions("k", "1", SetOptions{IfAbsent: true}); err != nil || !r.Written {
+		t.Fatalf("NX on a missing key: %+v %v", r, err)
+	}
+	if r, err := se.SetWithOptions("k", "2", SetOptions{IfAbsent: true}); err != nil || r.Written || r.Old != "1" {
+		t.Fatalf("NX on an existing key: %+v %v", r, err)
+	}
+
+	later := time.Now().Add(time.Hour)
+	se.SetWithOptions("k", "2", SetOptions{ExpireAt: later})
+	se.SetWithOptions("k", "3", SetOptions{KeepTTL: true})
+	if e, _, _ := se.lookupLive("k"); e.Value != "3" || e.ExpireAt != uint64(later.UnixMilli()) {
+		t.Fatalf("KEEPTTL lost the expiry: %+v", e)
+	}
+
+	// An expired key is absent, so NX may write it again.
+	se.SetWithOptions("gone", "x", SetOptions{ExpireAt: time.Now().Add(-time.Second)})
+	if _, found, _ := se.Get("gone"); found {
+		t.Fatal("expired key is visible")
+	}
+	if r, _ := se.SetWithOptions("gone", "y", SetOptions{IfAbsent: true}); !r.Written || r.Existed {
+		t.Fatalf("NX on an expired key: %+v", r)
+	}
+	se.SetWithOptions("gone", "x", SetOptions{ExpireAt: time.Now().Add(50 * time.Millisecond)})
+
+	// Enough writes to flush some expiries to sstables, the rest stays in
+	// the log.
+	for i := 0; i < 50; i++ {
+		se.SetWithOptions(fmt.Sprintf("ttl-%02d", i), "v", SetOptions{ExpireAt: later})
+	}
+	se.Close()
+	time.Sleep(60 * time.Millisecond)
+
+	se = openTestEngine(t, dir)
+	defer se.Close()
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("ttl-%02d", i)
+		if e, found, err := se.lookupLive(key); err != nil || !found || e.ExpireAt != uint64(later.UnixMilli()) {
+			t.Fatalf("expiry of %s lost after reopen: %+v %v %v", key, e, found, err)
+		}
+	}
+	if _, found, _ := se.Get("gone"); found {
+		t.Fatal("key expired while closed is visible after reopen")
+	}
+	if keys, _ := se.Keys(); len(keys) != 51 {
+		t.Fatalf("Keys returned %d keys, want 51", len(keys))
+	}
+}
+
+func TestEngineActiveExpiry(t *testing.T) {
+	dir := t.TempDir()
+	// Compaction would drop expired values before active expiry gets to
+	// them, so it is kept from running.
+	open := func(now func() time.Time) *StorageEngine {
+		se, err := NewStorageEngine(&Config{
+			Dir:             dir,
+			WriteBufferSize: 512,
+			ActiveExpiryHz:  100,
+			Compaction:      CompactionConfig{Leveled: LeveledConfig{L0Trigger: 1000}},
+			Now:             now,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return se
+	}
+	waitExpired := func(se *StorageEngine, n uint64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for se.expiring.expired.Load() < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("active expiry deleted %d keys, want %d", se.expiring.expired.Load(), n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	se := open(nil)
+	soon := time.Now().Add(20 * time.Millisecond)
+	for i := 0; i < 100; i++ {
+		se.SetWithOptions(fmt.Sprintf("short-%03d", i), "v", SetOptions{ExpireAt: soon})
+		se.SetWithOptions(fmt.Sprintf("long-%03d", i), "v", SetOptions{ExpireAt: soon.Add(time.Hour)})
+	}
+	se.Set("forever", "v")
+	waitExpired(se, 100)
+	se.Close()
+
+	// The remaining expiries were flushed to sstables or are replayed from
+	// the log, and are found again after a restart. Rather than waiting an
+	// hour for them, the clock moves forward.
+	se = open(func() time.Time { return time.Now().Add(2 * time.Hour) })
+	defer se.Close()
+	waitExpired(se, 100)
+	if n := se.expiring.len(); n != 0 {
+		t.Fatalf("%d keys left in the expiry index", n)
+	}
+	if keys, _ := se.Keys(); len(keys) != 1 || keys[0] != "forever" {
+		t.Fatalf("unexpected keys after expiry: %v", keys)
+	}
+}
+
+func TestEngineScanReturnsEveryKeyWhileWriting(t *testing.T) {
+	se := openTestEngine(t, t.TempDir())
+	defer se.Close()
+
+	const n = 300
+	for i := 0; i < n; i++ {
+		if err := se.Set(fmt.Sprintf("key-%03d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := map[string]int{}
+	start := ""
+	for round := 0; ; round++ {
+		keys, next, err := se.Scan(start, 7, func(key string) bool { return key[len(key)-1] != 'x' })
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys {
+			seen[key]++
+		}
+		// Writes between calls: new keys all over the keyspace, some of
+		// them deleted again, and keys that never match.
+		se.Set(fmt.Sprintf("key-%03d-new", round), "v")
+		se.Set(fmt.Sprintf("key-%03dx", round), "v")
+		se.Delete(fmt.Sprintf("key-%03d-new", round/2))
+		if next == "" {
+			break
+		}
+		start = next
+	}
+
+	for i := 0; i < n; i++ {
+		if key := fmt.Sprintf("key-%03d", i); seen[key] != 1 {
+			t.Fatalf("%s returned %d times", key, seen[key])
+		}
+	}
+	for key := range seen {
+		if key[len(key)-1] == 'x' {
+			t.Fatalf("%s returned despite the filter", key)
+		}
+	}
+}
+
+func TestEngineKeysWithPrefix(t *testing.T) {
+	se := openTestEngine(t, t.TempDir())
+	defer se.Close()
+
+	for i := 0; i < 100; i++ {
+		se.Set(fmt.Sprintf("order:%03d", i), "v")
+		se.Set(fmt.Sprintf("user:%03d", i), "v")
+	}
+	se.Delete("user:050")
+	se.SetWithOptions("user:051", "v", SetOptions{ExpireAt: time.Now().Add(-time.Second)})
+	se.Set("user", "v")
+	se.Set("userz", "v")
+
+	keys, err := se.KeysWithPrefix("user:", nil)
+	if err != nil || len(keys) != 98 || keys[0] != "user:000" || keys[97] != "user:099" {
+		t.Fatalf("unexpected keys with prefix: %d %v", len(keys), err)
+	}
+	keys, _ = se.KeysWithPrefix("user:0", func(key string) bool { return key[len(key)-1] == '7' })
+	if len(keys) != 10 {
+		t.Fatalf("unexpected matching keys: %v", keys)
+	}
+	if n, err := se.KeyCount(); err != nil || n != 200 {
+		t.Fatalf("KeyCount = %d %v, want 200", n, err)
+	}
+}
+
+func TestEngineBatchesAreAllOrNothing(t *testing.T) {
+	dir := t.TempDir()
+	se, err := NewStorageEngine(&Config{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	se.Set("c", "old")
+	if written, err := se.SetMany([]KeyValue{{"a", "1"}, {"b", "2"}}, false); err != nil || !written {
+		t.Fatalf("SetMany: %v %v", written, err)
+	}
+	if written, err := se.SetMany([]KeyValue{{"d", "4"}, {"c", "3"}}, true); err != nil || written {
+		t.Fatalf("SetMany with an existing key: %v %v", written, err)
+	}
+	if _, found, _ := se.Get("d"); found {
+		t.Fatal("SetMany wrote a key although another one existed")
+	}
+	values, found, err := se.GetMany([]string{"a", "nope", "c", "a"})
+	if err != nil || fmt.Sprint(values, found) != "[1  old 1] [true false true true]" {
+		t.Fatalf("GetMany: %q %v %v", values, found, err)
+	}
+	if n, err := se.CountExisting([]string{"a", "a", "nope"}); err != nil || n != 2 {
+		t.Fatalf("CountExisting: %d %v", n, err)
+	}
+	if n, err := se.DeleteMany([]string{"c", "c", "nope"}); err != nil || n != 1 {
+		t.Fatalf("DeleteMany: %d %v", n, err)
+	}
+	se.Close()
+
+	// Power loss half way through appending another batch.
+	segments, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	last := segments[len(segments)-1]
+	rec, _ := (&wal.WAL{}).EncodeBatch(1, 1, 1000, []wal.BatchOp{{Key: "x", Value: "1"}, {Key: "a", Deleted: true}})
+	f, err := os.OpenFile(last, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(rec[:len(rec)-3])
+	f.Close()
+
+	se, err = NewStorageEngine(&Config{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer se.Close()
+	values, found, err = se.GetMany([]string{"a", "b", "c", "x"})
+	if err != nil || fmt.Sprint(values, found) != "[1 2  ] [true true false false]" {
+		t.Fatalf("after recovery: %q %v %v", values, found, err)
+	}
+}
+
+func TestEngineWriteBatch(t *testing.T) {
+	dir := t.TempDir()
+	se := openTestEngine(t, dir)
+	se.Set("gone", "v")
+
+	b := NewWriteBatch()
+	b.Put("a", "1")
+	b.PutWithExpiry("b", "2", time.Now().Add(time.Hour))
+	b.Delete("gone")
+	b.Put("a", "3")
+	before := se.lastSeq
+	if err := se.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if se.lastSeq != before+4 {
+		t.Fatalf("batch of 4 took sequence numbers %d to %d", before+1, se.lastSeq)
+	}
+	b.Reset()
+	if err := se.Write(b); err != nil || b.Len() != 0 {
+		t.Fatalf("empty batch: %v", err)
+	}
+	b.Put(string(make([]byte, MaxKeySize+1)), "v")
+	if err := se.Write(b); err != ErrKeyTooLarge {
+		t.Fatalf("oversized key: got %v, want ErrKeyTooLarge", err)
+	}
+	se.Close()
+
+	se = openTestEngine(t, dir)
+	defer se.Close()
+	values, found, err := se.GetMany([]string{"a", "b", "gone"})
+	if err != nil || fmt.Sprint(values, found) != "[3 2 ] [true true false]" {
+		t.Fatalf("after reopening: %q %v %v", values, found, err)
+	}
+	if at, _, _ := se.ExpireTime("b"); time.Until(at) < 59*time.Minute {
+		t.Fatalf("expiry of b lost: %v", at)
+	}
+}
+
+func TestEngineUpdateIsAtomic(t *testing.T) {
+	se := openTestEngine(t, t.TempDir())
+	defer se.Close()
+	se.SetWithOptions("n", "0", SetOptions{ExpireAt: time.Now().Add(time.Hour)})
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				_, err := se.Update("n", func(value string, found bool) (string, error) {
+					var n int
+					fmt.Sscan(value, &n)
+					return fmt.Sprint(n + 1), nil
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, _, _ := se.Get("n"); value != "800" {
+		t.Fatalf("got %s after 800 concurrent increments", value)
+	}
+	if at, _, _ := se.ExpireTime("n"); at.IsZero() {
+		t.Fatal("Update dropped the expiry")
+	}
+	failed := fmt.Errorf("refused")
+	if _, err := se.Update("n", func(string, bool) (string, error) { return "x", failed }); err != failed {
+		t.Fatalf("got %v, want the error of fn", err)
+	}
+	if value, _, _ := se.Get("n"); value != "800" {
+		t.Fatalf("a failed update wrote %s", value)
+	}
+}
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+/*
+Keys expire in two ways. Readers treat a value whose expiry has passed as
+missing from the moment it expires (lazy expiry), but the value keeps
+taking space until something removes it. Compaction drops expired values
+from the tables it rewrites, and the expiry loop deletes them sooner (active
+expiry): like Redis, it repeatedly samples keys known to have an expiry and
+deletes those that are due, taking another sample right away while more
+than a quarter of a sample was due.
+*/
+
+const (
+	defaultActiveExpiryHz = 10
+
+	// expirySampleSize is the number of keys checked per sample.
+	expirySampleSize = 20
+	// expiryCycleBudget bounds the time one expiry cycle may take, so that
+	// a burst of expired keys does not hold up writers for long.
+	expiryCycleBudget = 25 * time.Millisecond
+)
+
+// expiryIndex holds the keys that may have an expiry, with the expiry they
+// were last seen with. It is only a hint: entries may be stale, so every key
+// is looked up again before it is deleted.
+type expiryIndex struct {
+	mu   sync.Mutex
+	keys map[string]uint64
+
+	// expired counts the keys deleted by active expiry.
+	expired atomic.Uint64
+}
+
+func newExpiryIndex() *expiryIndex {
+	return &expiryIndex{keys: map[string]uint64{}}
+}
+
+// note records that key was written with expiry expireAt, zero meaning it
+// no longer expires.
+func (x *expiryIndex) note(key string, expireAt uint64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if expireAt == 0 {
+		delete(x.keys, key)
+		return
+	}
+	x.keys[key] = expireAt
+}
+
+// noteOlder records the expiry of key found in an older version than the
+// one the index may already know about, which therefore takes precedence.
+func (x *expiryIndex) noteOlder(key string, expireAt uint64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.keys[key]; !ok {
+		x.keys[key] = expireAt
+	}
+}
+
+// sample picks up to n keys of the index and returns those due by now,
+// along with the number of keys picked. Go randomizes where iteration over
+// a map starts, which makes the pick random enough.
+func (x *expiryIndex) sample(n int, now uint64) (due []string, picked int) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for key, expireAt := range x.keys {
+		if picked == n {
+			break
+		}
+		picked++
+		if expireAt <= now {
+			due = append(due, key)
+		}
+	}
+	return due, picked
+}
+
+func (x *expiryIndex) len() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return len(x.keys)
+}
+
+// expiryLoop runs active expiry ActiveExpiryHz times a second. It starts by
+// indexing the expiries stored in SSTables; those of the memtables were
+// indexed while the log was replayed.
+func (se *StorageEngine) expiryLoop() {
+	defer se.wg.Done()
+	if err := se.indexTableExpiries(); err != nil {
+		log.Error().Err(err).Msg("Failed to index expiring keys of sstables")
+	}
+
+	ticker := time.NewTicker(time.Second / time.Duration(se.config.ActiveExpiryHz))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			se.expireCycle()
+		case <-se.closeCh:
+			return
+		}
+	}
+}
+
+// indexTableExpiries adds the keys with an expiry found in the live SSTables
+// to the expiry index. An entry only counts if it is the newest version of
+// its key; a replayed tombstone, for one, has already taken the key out of
+// the index.
+func (se *StorageEngine) indexTableExpiries() error {
+	v := se.currentView()
+	defer v.release()
+
+	for _, t := range v.version.tables() {
+		it := t.iterator()
+		it.keysOnly = true
+		for it.next() {
+			e := it.entry()
+			if e.Deleted || e.ExpireAt == 0 {
+				continue
+			}
+			newest, found, err := v.find(e.Key)
+			if err != nil {
+				return err
+			}
+			if found && newest.Seq == e.Seq {
+				se.expiring.noteOlder(e.Key, e.ExpireAt)
+			}
+		}
+		if err := it.err(); err != nil {
+			return err
+		}
+		select {
+		case <-se.closeCh:
+			return nil
+		default:
+		}
+	}
+	return nil
+}
+
+// expireCycle deletes expired keys found by sampling the expiry index until
+// a sample is mostly live or the cycle has used up its time budget.
+func (se *StorageEngine) expireCycle() {
+	deadline := time.Now().Add(expiryCycleBudget)
+	for {
+		due, picked := se.expiring.sample(expirySampleSize, se.now())
+		for _, key := range due {
+			if err := se.expireKey(key); err != nil {
+				log.Error().Err(err).Msg("Failed to delete expired key")
+				return
+			}
+		}
+		if picked == 0 || len(due)*4 <= picked || time.Now().After(deadline) {
+			return
+		}
+	}
+}
+
+// expireKey deletes key if it has expired, and otherwise corrects what the
+// expiry index knows about it.
+func (se *StorageEngine) expireKey(key string) error {
+	se.writeMu.Lock()
+
+	e, found, err := se.lookup(key)
+	if err != nil {
+		se.writeMu.Unlock()
+		return err
+	}
+	if !found || e.Deleted || e.live(se.now()) {
+		expireAt := uint64(0)
+		if found && !e.Deleted {
+			expireAt = e.ExpireAt
+		}
+		se.expiring.note(key, expireAt)
+		se.writeMu.Unlock()
+		return nil
+	}
+
+	if err := se.deleteLocked(key); err != nil {
+		return err
+	}
+	se.expiring.expired.Add(1)
+	return nil
+}
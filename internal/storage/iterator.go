@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"container/heap"
+)
+
+// entryIterator walks entries in key order. next advances to the following
+// entry and reports whether there is one; err reports why iteration stopped
+// early, if it did.
+type entryIterator interface {
+	next() bool
+	entry() entry
+	err() error
+}
+
+// mergingIterator merges several sorted iterators into one. Entries come out
+// ordered by key and, for equal keys, newest first: by sequence number and
+// then by the position of the source, earlier sources being newer. Callers
+// that only want the live version of each key keep the first entry of every
+// key and skip the rest.
+type mergingIterator struct {
+	h       mergeHeap
+	cur     entry
+	lastErr error
+	started bool
+}
+
+type mergeSource struct {
+	it       entryIterator
+	priority int
+}
+
+type mergeHeap []*mergeSource
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	a, b := h[i].it.entry(), h[j].it.entry()
+	if a.Key != b.Key {
+		return a.Key < b.Key
+	}
+	if a.Seq != b.Seq {
+		return a.Seq > b.Seq
+	}
+	return h[i].priority < h[j].priority
+}
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x any)   { *h = append(*h, x.(*mergeSource)) }
+func (h *mergeHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// newMergingIterator merges sources, which are given newest first.
+func newMergingIterator(sources ...entryIterator) *mergingIterator {
+	m := &mergingIterator{}
+	for i, it := range sources {
+		if it.next() {
+			m.h = append(m.h, &mergeSource{it: it, priority: i})
+		} else if err := it.err(); err != nil {
+			m.lastErr = err
+		}
+	}
+	heap.Init(&m.h)
+	return m
+}
+
+func (m *mergingIterator) next() bool {
+	if m.lastErr != nil {
+		return false
+	}
+	if m.started && len(m.h) > 0 {
+		top := m.h[0]
+		if top.it.next() {
+			heap.Fix(&m.h, 0)
+		} else {
+			heap.Pop(&m.h)
+			if err := top.it.err(); err != nil {
+				m.lastErr = err
+				return false
+			}
+		}
+	}
+	m.started = true
+	if len(m.h) == 0 {
+		return false
+	}
+	m.cur = m.h[0].it.entry()
+	return true
+}
+
+func (m *mergingIterator) entry() entry {
+	return m.cur
+}
+
+func (m *mergingIterator) err() error {
+	return m.lastErr
+}
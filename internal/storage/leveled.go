@@ -0,0 +1,119 @@
+package storage
+
+// LeveledConfig tunes the leveled compaction strategy, which keeps every
+// level below 0 free of overlapping tables and each level a fixed factor
+// larger than the one above. Reads touch few tables, at the cost of
+// rewriting data once for every level it moves through.
+type LeveledConfig struct {
+	// L0Trigger is the number of level 0 tables that triggers a compaction
+	// into level 1.
+	L0Trigger int
+	// LevelBaseSize is the size in bytes level 1 may grow to before it is
+	// compacted into level 2.
+	LevelBaseSize int64
+	// LevelMultiplier is the factor by which the size limit grows from one
+	// level to the next.
+	LevelMultiplier int
+	// TargetFileSize is the size in bytes at which compaction output is split
+	// into a new table.
+	TargetFileSize int64
+}
+
+func (c LeveledConfig) withDefaults() LeveledConfig {
+	if c.L0Trigger <= 0 {
+		c.L0Trigger = 4
+	}
+	if c.LevelBaseSize <= 0 {
+		c.LevelBaseSize = 10 * 1024 * 1024
+	}
+	if c.LevelMultiplier <= 1 {
+		c.LevelMultiplier = 10
+	}
+	if c.TargetFileSize <= 0 {
+		c.TargetFileSize = 2 * 1024 * 1024
+	}
+	return c
+}
+
+// maxLevelSize is the size level may reach before it needs compacting.
+func (c LeveledConfig) maxLevelSize(level int) int64 {
+	size := c.LevelBaseSize
+	for l := 1; l < level; l++ {
+		size *= int64(c.LevelMultiplier)
+	}
+	return size
+}
+
+type leveledStrategy struct {
+	cfg LeveledConfig
+	// compactPointer holds, per level, the largest key of the last table
+	// compacted out of it.
+	compactPointer [numLevels]string
+}
+
+// pick scores level 0 by its number of tables and every other level by its
+// size relative to its limit, and compacts the level scoring highest.
+func (s *leveledStrategy) pick(v *version, busy map[*SSTable]bool) *compaction {
+	var best *compaction
+	bestScore := 1.0
+	for level := 0; level < numLevels-1; level++ {
+		var score float64
+		if level == 0 {
+			score = float64(len(v.levels[0])) / float64(s.cfg.L0Trigger)
+		} else {
+			score = float64(levelSize(v.levels[level])) / float64(s.cfg.maxLevelSize(level))
+		}
+		if score < bestScore {
+			continue
+		}
+		if c := s.build(v, level, busy); c != nil {
+			best, bestScore = c, score
+		}
+	}
+	if best != nil {
+		_, s.compactPointer[best.level] = keyRange(best.inputs[0])
+	}
+	return best
+}
+
+// build assembles the inputs for compacting level into level+1, or returns
+// nil if every candidate is busy.
+func (s *leveledStrategy) build(v *version, level int, busy map[*SSTable]bool) *compaction {
+	var candidates [][]*SSTable
+	if level == 0 {
+		// Level 0 tables overlap, so they are compacted all together; that
+		// way a newer version of a key can never be left behind in level 0
+		// while an older one moves down.
+		candidates = [][]*SSTable{v.levels[0]}
+	} else {
+		// Start after the key where the previous compaction of this level
+		// stopped, so that the whole key space gets compacted in turn.
+		tables := v.levels[level]
+		start := 0
+		for start < len(tables) && tables[start].MinKey <= s.compactPointer[level] {
+			start++
+		}
+		for i := range tables {
+			candidates = append(candidates, []*SSTable{tables[(start+i)%len(tables)]})
+		}
+	}
+
+	for _, inputs := range candidates {
+		if len(inputs) == 0 || anyBusy(inputs, busy) {
+			continue
+		}
+		minKey, maxKey := keyRange(inputs)
+		next := overlapping(v.levels[level+1], minKey, maxKey)
+		if anyBusy(next, busy) {
+			continue
+		}
+		return &compaction{
+			level:         level,
+			output:        level + 1,
+			inputs:        [2][]*SSTable{inputs, next},
+			base:          v.levels[level+2:],
+			maxOutputSize: s.cfg.TargetFileSize,
+		}
+	}
+	return nil
+}
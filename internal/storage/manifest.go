@@ -0,0 +1,420 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/sebzz2k2/vaultic/internal/wal"
+	"github.com/sebzz2k2/vaultic/pkg/utils"
+)
+
+// ErrManifestCorruption is wrapped by every error caused by a MANIFEST that
+// cannot be decoded or that references tables which are missing.
+var ErrManifestCorruption = errors.New("manifest corruption")
+
+const (
+	currentFileName = "CURRENT"
+	manifestPrefix  = "MANIFEST-"
+
+	// manifestHeaderSize is the length and the CRC in front of every record.
+	manifestHeaderSize = 8
+)
+
+// Tags of the fields of an encoded version edit. Every field is a tag
+// followed by uvarints; a file is its level, number and size.
+const (
+	tagLastSeq     = 1
+	tagNextFileNum = 2
+	tagLogEnd      = 3
+	tagDeletedFile = 4
+	tagNewFile     = 5
+)
+
+// fileMeta describes a live table as the manifest records it.
+type fileMeta struct {
+	level int
+	num   uint64
+	size  int64
+}
+
+// versionEdit is one record of the manifest: the tables a flush or a
+// compaction added and removed, together with the counters that must
+// survive a restart. Fields that are not set leave the recovered value as
+// it was.
+type versionEdit struct {
+	lastSeq        uint64
+	hasLastSeq     bool
+	nextFileNum    uint64
+	hasNextFileNum bool
+	logEnd         int64
+	hasLogEnd      bool
+	deleted        []fileMeta
+	added          []fileMeta
+}
+
+func (e *versionEdit) setLastSeq(seq uint64) {
+	e.lastSeq, e.hasLastSeq = seq, true
+}
+
+func (e *versionEdit) setNextFileNum(num uint64) {
+	e.nextFileNum, e.hasNextFileNum = num, true
+}
+
+func (e *versionEdit) setLogEnd(offset int64) {
+	e.logEnd, e.hasLogEnd = offset, true
+}
+
+func (e *versionEdit) addTable(t *SSTable) {
+	e.added = append(e.added, fileMeta{level: t.Level, num: t.FileNum, size: t.Size})
+}
+
+func (e *versionEdit) deleteTable(t *SSTable) {
+	e.deleted = append(e.deleted, fileMeta{level: t.Level, num: t.FileNum})
+}
+
+func (e *versionEdit) encode() []byte {
+	var b []byte
+	if e.hasLastSeq {
+		b = binary.AppendUvarint(b, tagLastSeq)
+		b = binary.AppendUvarint(b, e.lastSeq)
+	}
+	if e.hasNextFileNum {
+		b = binary.AppendUvarint(b, tagNextFileNum)
+		b = binary.AppendUvarint(b, e.nextFileNum)
+	}
+	if e.hasLogEnd {
+		b = binary.AppendUvarint(b, tagLogEnd)
+		b = binary.AppendUvarint(b, uint64(e.logEnd))
+	}
+	for _, f := range e.deleted {
+		b = binary.AppendUvarint(b, tagDeletedFile)
+		b = binary.AppendUvarint(b, uint64(f.level))
+		b = binary.AppendUvarint(b, f.num)
+	}
+	for _, f := range e.added {
+		b = binary.AppendUvarint(b, tagNewFile)
+		b = binary.AppendUvarint(b, uint64(f.level))
+		b = binary.AppendUvarint(b, f.num)
+		b = binary.AppendUvarint(b, uint64(f.size))
+	}
+	return b
+}
+
+func decodeVersionEdit(b []byte) (*versionEdit, error) {
+	e := &versionEdit{}
+	next := func() (uint64, error) {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, fmt.Errorf("%w: truncated version edit", ErrManifestCorruption)
+		}
+		b = b[n:]
+		return v, nil
+	}
+	fields := func(n int) ([]uint64, error) {
+		vals := make([]uint64, n)
+		for i := range vals {
+			v, err := next()
+			if err != nil {
+				return nil, err
+			}
+			vals[i] = v
+		}
+		return vals, nil
+	}
+
+	for len(b) > 0 {
+		tag, err := next()
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case tagLastSeq, tagNextFileNum, tagLogEnd:
+			v, err := next()
+			if err != nil {
+				return nil, err
+			}
+			switch tag {
+			case tagLastSeq:
+				e.setLastSeq(v)
+			case tagNextFileNum:
+				e.setNextFileNum(v)
+			default:
+				e.setLogEnd(int64(v))
+			}
+		case tagDeletedFile:
+			v, err := fields(2)
+			if err != nil {
+				return nil, err
+			}
+			e.deleted = append(e.deleted, fileMeta{level: int(v[0]), num: v[1]})
+		case tagNewFile:
+			v, err := fields(3)
+			if err != nil {
+				return nil, err
+			}
+			if v[0] >= numLevels {
+				return nil, fmt.Errorf("%w: table %d has level %d", ErrManifestCorruption, v[1], v[0])
+			}
+			e.added = append(e.added, fileMeta{level: int(v[0]), num: v[1], size: int64(v[2])})
+		default:
+			return nil, fmt.Errorf("%w: unknown version edit tag %d", ErrManifestCorruption, tag)
+		}
+	}
+	return e, nil
+}
+
+// manifestState is what replaying a manifest yields: the live tables and
+// the counters of the last edit that set them.
+type manifestState struct {
+	files       map[uint64]fileMeta
+	lastSeq     uint64
+	nextFileNum uint64
+	logEnd      int64
+}
+
+func newManifestState() *manifestState {
+	return &manifestState{files: map[uint64]fileMeta{}}
+}
+
+func (s *manifestState) apply(e *versionEdit) {
+	if e.hasLastSeq {
+		s.lastSeq = max(s.lastSeq, e.lastSeq)
+	}
+	if e.hasNextFileNum {
+		s.nextFileNum = max(s.nextFileNum, e.nextFileNum)
+	}
+	if e.hasLogEnd {
+		s.logEnd = max(s.logEnd, e.logEnd)
+	}
+	for _, f := range e.deleted {
+		delete(s.files, f.num)
+	}
+	for _, f := range e.added {
+		s.files[f.num] = f
+	}
+}
+
+// snapshot returns a single edit recreating the state.
+func (s *manifestState) snapshot() *versionEdit {
+	e := &versionEdit{}
+	e.setLastSeq(s.lastSeq)
+	e.setNextFileNum(s.nextFileNum)
+	e.setLogEnd(s.logEnd)
+	for _, f := range s.files {
+		e.added = append(e.added, f)
+	}
+	return e
+}
+
+func manifestName(num uint64) string {
+	return fmt.Sprintf("%s%06d", manifestPrefix, num)
+}
+
+// readManifest replays the manifest CURRENT points to. It reports false if
+// there is no CURRENT file, as in a directory written before manifests
+// existed. A torn record at the end of the manifest is the edit of a flush or
+// compaction interrupted by a crash before it took effect and is ignored.
+func readManifest(dir string) (*manifestState, bool, error) {
+	current, err := os.ReadFile(filepath.Join(dir, currentFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	name := strings.TrimSpace(string(current))
+	if !strings.HasPrefix(name, manifestPrefix) {
+		return nil, false, fmt.Errorf("%w: CURRENT names %q", ErrManifestCorruption, name)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %v", ErrManifestCorruption, err)
+	}
+
+	state := newManifestState()
+	offset := 0
+	for offset < len(data) {
+		rest := data[offset:]
+		torn := len(rest) < manifestHeaderSize
+		var payload []byte
+		if !torn {
+			length := int(binary.BigEndian.Uint32(rest[:4]))
+			if manifestHeaderSize+length > len(rest) {
+				torn = true
+			} else {
+				payload = rest[manifestHeaderSize : manifestHeaderSize+length]
+				if binary.BigEndian.Uint32(rest[4:8]) != utils.Crc32(string(payload)) {
+					if manifestHeaderSize+length < len(rest) {
+						return nil, false, fmt.Errorf("%w: bad checksum of record at offset %d of %s", ErrManifestCorruption, offset, name)
+					}
+					torn = true
+				}
+			}
+		}
+		if torn {
+			log.Warn().Str("manifest", name).Int("offset", offset).Msg("Ignoring torn record at the end of the manifest")
+			break
+		}
+
+		edit, err := decodeVersionEdit(payload)
+		if err != nil {
+			return nil, false, fmt.Errorf("record at offset %d of %s: %w", offset, name, err)
+		}
+		state.apply(edit)
+		offset += manifestHeaderSize + len(payload)
+	}
+	return state, true, nil
+}
+
+// manifest is the append-only log of version edits. Every edit is synced
+// before the engine acts on it, so after a crash the manifest names exactly
+// the tables that were live: a table is added only once it is complete and
+// in place, and deleted from disk only once an edit has removed it.
+type manifest struct {
+	file *os.File
+	name string
+	size int64
+}
+
+// createManifest writes a new manifest holding the snapshot of state and
+// points CURRENT at it.
+func createManifest(dir string, num uint64, state *manifestState) (*manifest, error) {
+	name := manifestName(num)
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{file: file, name: name}
+	if err := m.append(state.snapshot()); err != nil {
+		m.close()
+		return nil, err
+	}
+	if err := setCurrent(dir, name); err != nil {
+		m.close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// append writes and syncs one edit. A failed write is cut off again, so the
+// manifest never holds a torn record in front of later ones.
+func (m *manifest) append(e *versionEdit) error {
+	payload := e.encode()
+	rec := make([]byte, 0, manifestHeaderSize+len(payload))
+	rec = binary.BigEndian.AppendUint32(rec, uint32(len(payload)))
+	rec = binary.BigEndian.AppendUint32(rec, utils.Crc32(string(payload)))
+	rec = append(rec, payload...)
+
+	if _, err := m.file.Write(rec); err != nil {
+		m.file.Truncate(m.size)
+		m.file.Seek(m.size, io.SeekStart)
+		return err
+	}
+	if err := m.file.Sync(); err != nil {
+		return err
+	}
+	m.size += int64(len(rec))
+	return nil
+}
+
+func (m *manifest) close() error {
+	return m.file.Close()
+}
+
+// setCurrent atomically points CURRENT at the named manifest.
+func setCurrent(dir, name string) error {
+	tmp := filepath.Join(dir, currentFileName+tmpExt)
+	if err := os.WriteFile(tmp, []byte(name+"\n"), 0644); err != nil {
+		return err
+	}
+	f, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, currentFileName)); err != nil {
+		return err
+	}
+	return wal.SyncDir(dir)
+}
+
+// openLevels opens every table the manifest lists as live.
+func openLevels(dir string, state *manifestState) ([numLevels][]*SSTable, error) {
+	var levels [numLevels][]*SSTable
+	closeAll := func() {
+		for _, tables := range levels {
+			for _, t := range tables {
+				t.Close()
+			}
+		}
+	}
+	for _, f := range state.files {
+		t, err := openSSTable(sstablePath(dir, f.num))
+		if err != nil {
+			closeAll()
+			if os.IsNotExist(err) {
+				return levels, fmt.Errorf("%w: live table %06d%s is missing", ErrManifestCorruption, f.num, sstableExt)
+			}
+			return levels, err
+		}
+		if t.Size != f.size {
+			t.Close()
+			closeAll()
+			return levels, fmt.Errorf("%w: table %s has %d bytes, expected %d", ErrManifestCorruption, t.Path, t.Size, f.size)
+		}
+		t.Level = f.level
+		levels[f.level] = append(levels[f.level], t)
+	}
+	sortLevels(&levels)
+	return levels, nil
+}
+
+// removeObsoleteFiles deletes whatever a crash may have left behind: tables
+// the manifest does not list, temporary files and old manifests.
+func removeObsoleteFiles(dir string, levels [numLevels][]*SSTable, manifest string) {
+	live := map[string]bool{manifest: true, currentFileName: true}
+	for _, tables := range levels {
+		for _, t := range tables {
+			live[filepath.Base(t.Path)] = true
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list data directory")
+		return
+	}
+	removed := false
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || live[name] {
+			continue
+		}
+		_, isTable := parseSSTableName(strings.TrimSuffix(name, tmpExt))
+		if !isTable && name != currentFileName+tmpExt && !strings.HasPrefix(name, manifestPrefix) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			log.Error().Err(err).Str("file", name).Msg("Failed to remove obsolete file")
+			continue
+		}
+		log.Info().Str("file", name).Msg("Removed obsolete file")
+		removed = true
+	}
+	if removed {
+		if err := wal.SyncDir(dir); err != nil {
+			log.Error().Err(err).Msg("Failed to sync data directory")
+		}
+	}
+}
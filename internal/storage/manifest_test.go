@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func liveFileNums(se *StorageEngine) []uint64 {
+	se.mu.RLock()
+	defer se.mu.RUnlock()
+	var nums []uint64
+	for _, t := range se.current.tables() {
+		nums = append(nums, t.FileNum)
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	return nums
+}
+
+func TestManifestRecoversLiveTables(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{
+		Dir:             dir,
+		WriteBufferSize: 512,
+		Compaction:      CompactionConfig{Leveled: LeveledConfig{L0Trigger: 2, TargetFileSize: 1024}},
+	}
+	se, err := NewStorageEngine(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 400; i++ {
+		if err := se.Set(fmt.Sprintf("key-%04d", i%150), fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForCompactions(t, se)
+	live := liveFileNums(se)
+	se.Close()
+
+	// What a crash in the middle of a flush or compaction leaves behind.
+	orphans := []string{"999990.sst", "999991.sst.tmp", manifestName(999992)}
+	for _, name := range orphans {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	se, err = NewStorageEngine(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer se.Close()
+
+	if got := liveFileNums(se); fmt.Sprint(got) != fmt.Sprint(live) {
+		t.Fatalf("recovered tables %v, want %v", got, live)
+	}
+	for _, name := range orphans {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s was not removed", name)
+		}
+	}
+	for i := 250; i < 400; i++ {
+		key := fmt.Sprintf("key-%04d", i%150)
+		if val, found, _ := se.Get(key); !found || val != fmt.Sprintf("value-%d", i) {
+			t.Fatalf("%s = %q %v after reopen", key, val, found)
+		}
+	}
+}
+
+func TestManifestMissingTableFailsOpen(t *testing.T) {
+	dir := t.TempDir()
+	se := openTestEngine(t, dir)
+	for i := 0; i < 100; i++ {
+		se.Set(fmt.Sprintf("key-%03d", i), "value")
+	}
+	se.Close()
+
+	se = openTestEngine(t, dir)
+	live := liveFileNums(se)
+	se.Close()
+	if len(live) == 0 {
+		t.Fatal("expected flushed tables")
+	}
+	if err := os.Remove(sstablePath(dir, live[0])); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := NewStorageEngine(&Config{Dir: dir, WriteBufferSize: 512})
+	if !errors.Is(err, ErrManifestCorruption) {
+		t.Fatalf("expected manifest corruption, got %v", err)
+	}
+}
+
+func TestManifestTornTail(t *testing.T) {
+	dir := t.TempDir()
+	state := newManifestState()
+	state.lastSeq = 7
+	m, err := createManifest(dir, 1, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit := &versionEdit{}
+	edit.setLastSeq(42)
+	edit.added = append(edit.added, fileMeta{level: 2, num: 5, size: 100})
+	if err := m.append(edit); err != nil {
+		t.Fatal(err)
+	}
+	m.close()
+
+	path := filepath.Join(dir, manifestName(1))
+	intact, _ := os.ReadFile(path)
+
+	// A record cut short by a crash is dropped.
+	torn := &versionEdit{}
+	torn.setLastSeq(99)
+	rec := torn.encode()
+	if err := os.WriteFile(path, append(append([]byte{}, intact...), 0, 0, 0, byte(len(rec)), 1, 2), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, found, err := readManifest(dir)
+	if err != nil || !found {
+		t.Fatalf("torn tail: %v %v", found, err)
+	}
+	if got.lastSeq != 42 || got.files[5].level != 2 {
+		t.Fatalf("unexpected state %+v", got)
+	}
+
+	// A damaged record followed by others is corruption.
+	damaged := append([]byte{}, intact...)
+	damaged[manifestHeaderSize] ^= 0xff
+	if err := os.WriteFile(path, damaged, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readManifest(dir); !errors.Is(err, ErrManifestCorruption) {
+		t.Fatalf("expected manifest corruption, got %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package storage
+
+// memTableHeight is the number of levels used for every memtable skip list.
+const memTableHeight = 12
+
+// memTable is a skip list receiving writes together with the position in the
+// write-ahead log that its contents reach. Once frozen, logEnd tells recovery
+// which prefix of the log no longer has to be replayed after the memtable
+// has been written out as an SSTable.
+type memTable struct {
+	list   *SkipList
+	logEnd int64
+}
+
+func newMemTable(logEnd int64) *memTable {
+	return &memTable{
+		list:   NewSkipList(memTableHeight),
+		logEnd: logEnd,
+	}
+}
+
+func (m *memTable) empty() bool {
+	return m.list.GetLength() == 0
+}
+
+// get returns the version of key held by the memtable, tombstones included.
+func (m *memTable) get(key string) (entry, bool) {
+	node, found := m.list.Find(key)
+	if !found {
+		return entry{}, false
+	}
+	return entry{Key: node.Key, Value: node.Value, Deleted: node.Deleted, Seq: node.Seq, Ts: node.Ts, ExpireAt: node.ExpireAt}, true
+}
+
+func (m *memTable) iterator() entryIterator {
+	return m.iteratorFrom("")
+}
+
+// iteratorFrom returns an iterator over the memtable's entries with a key >=
+// start. It holds the skip list's lock for one step at a time, so the active
+// memtable can keep taking writes while it is consumed. Nodes are never
+// unlinked, so the iterator cannot lose its place.
+func (m *memTable) iteratorFrom(start string) entryIterator {
+	return &memTableIterator{list: m.list, start: start}
+}
+
+type memTableIterator struct {
+	list    *SkipList
+	start   string
+	node    *SkipListNode
+	started bool
+	cur     entry
+}
+
+func (it *memTableIterator) next() bool {
+	it.list.Lock()
+	defer it.list.Unlock()
+
+	if !it.started {
+		it.started = true
+		current := it.list.Head
+		for i := it.list.Level - 1; i >= 0; i-- {
+			for current.Next[i] != nil && current.Next[i].Key < it.start {
+				current = current.Next[i]
+			}
+		}
+		it.node = current.Next[0]
+	} else if it.node != nil {
+		it.node = it.node.Next[0]
+	}
+	if it.node == nil {
+		return false
+	}
+	node := it.node
+	it.cur = entry{Key: node.Key, Value: node.Value, Deleted: node.Deleted, Seq: node.Seq, Ts: node.Ts, ExpireAt: node.ExpireAt}
+	return true
+}
+
+func (it *memTableIterator) entry() entry {
+	return it.cur
+}
+
+func (it *memTableIterator) err() error {
+	return nil
+}
@@ -0,0 +1,128 @@
+package storage
+
+import "sort"
+
+// SizeTieredConfig tunes the size-tiered compaction strategy, which keeps
+// every table in level 0 and merges tables of similar size into one larger
+// table. Data is rewritten only about once per size tier, so writes are
+// cheap, while reads may have to look into more tables.
+type SizeTieredConfig struct {
+	// MinThreshold is the number of similarly sized tables needed before
+	// they are compacted.
+	MinThreshold int
+	// MaxThreshold is the most tables compacted at once.
+	MaxThreshold int
+	// BucketLow and BucketHigh bound the size of a table, relative to the
+	// average size of a bucket, for it to join the bucket.
+	BucketLow  float64
+	BucketHigh float64
+	// MinSSTableSize is the size in bytes below which all tables share one
+	// bucket, so that small flushes get merged regardless of their ratios.
+	MinSSTableSize int64
+}
+
+func (c SizeTieredConfig) withDefaults() SizeTieredConfig {
+	if c.MinThreshold < 2 {
+		c.MinThreshold = 4
+	}
+	if c.MaxThreshold < c.MinThreshold {
+		c.MaxThreshold = max(32, c.MinThreshold)
+	}
+	if c.BucketLow <= 0 || c.BucketLow >= 1 {
+		c.BucketLow = 0.5
+	}
+	if c.BucketHigh <= 1 {
+		c.BucketHigh = 1.5
+	}
+	if c.MinSSTableSize <= 0 {
+		c.MinSSTableSize = 50 * 1024 * 1024
+	}
+	return c
+}
+
+type sizeTieredStrategy struct {
+	cfg SizeTieredConfig
+}
+
+// pick groups the idle level 0 tables into buckets of similar size and
+// compacts the fullest bucket holding at least MinThreshold tables,
+// preferring the smaller tables when it holds more than MaxThreshold.
+// Tables in deeper levels, left behind by the leveled strategy, are not
+// touched.
+func (s *sizeTieredStrategy) pick(v *version, busy map[*SSTable]bool) *compaction {
+	var idle []*SSTable
+	for _, t := range v.levels[0] {
+		if !busy[t] {
+			idle = append(idle, t)
+		}
+	}
+
+	var best []*SSTable
+	for _, bucket := range s.buckets(idle) {
+		if len(bucket) < s.cfg.MinThreshold {
+			continue
+		}
+		bucket = bucket[:min(len(bucket), s.cfg.MaxThreshold)]
+		if best == nil || len(bucket) > len(best) ||
+			(len(bucket) == len(best) && levelSize(bucket) < levelSize(best)) {
+			best = bucket
+		}
+	}
+	if best == nil {
+		return nil
+	}
+
+	// Any table left out may hold an older version of a key, so it keeps
+	// tombstones alive.
+	inputs := map[*SSTable]bool{}
+	for _, t := range best {
+		inputs[t] = true
+	}
+	var others []*SSTable
+	for _, t := range v.tables() {
+		if !inputs[t] {
+			others = append(others, t)
+		}
+	}
+
+	// The level keeps its tables ordered by age, which the merge relies on
+	// to rank the inputs.
+	sort.Slice(best, func(i, j int) bool { return levelOrder(best[i], best[j]) })
+	return &compaction{
+		level:  0,
+		output: 0,
+		inputs: [2][]*SSTable{best, nil},
+		base:   [][]*SSTable{others},
+	}
+}
+
+// buckets sorts tables by size and groups them into buckets of tables whose
+// size is close to the bucket's average. Each bucket is ordered smallest
+// first.
+func (s *sizeTieredStrategy) buckets(tables []*SSTable) [][]*SSTable {
+	sorted := append([]*SSTable{}, tables...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Size < sorted[j].Size })
+
+	var buckets [][]*SSTable
+	var averages []float64
+	for _, t := range sorted {
+		size := float64(t.Size)
+		placed := false
+		for i, avg := range averages {
+			similar := size >= avg*s.cfg.BucketLow && size <= avg*s.cfg.BucketHigh
+			small := t.Size < s.cfg.MinSSTableSize && avg < float64(s.cfg.MinSSTableSize)
+			if similar || small {
+				n := float64(len(buckets[i]))
+				buckets[i] = append(buckets[i], t)
+				averages[i] = (avg*n + size) / (n + 1)
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			buckets = append(buckets, []*SSTable{t})
+			averages = append(averages, size)
+		}
+	}
+	return buckets
+}
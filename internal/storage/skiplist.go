@@ -17,13 +17,18 @@ import (
 //   - Value: The value associated with the key.
 //   - Deleted: A boolean flag indicating whether the node has been deleted.
 //   - Ts: A timestamp indicating when the node was last modified.
+//   - Seq: The sequence number of the write that last modified the node.
+//   - ExpireAt: When the key expires in Unix milliseconds, zero if it does
+//     not.
 //   - Next: An array of pointers to the next nodes at different levels.
 type SkipListNode struct {
-	Key     string
-	Value   string
-	Deleted bool
-	Ts      uint64
-	Next    []*SkipListNode
+	Key      string
+	Value    string
+	Deleted  bool
+	Ts       uint64
+	Seq      uint64
+	ExpireAt uint64
+	Next     []*SkipListNode
 }
 
 // SkipList represents a probabilistic data structure that allows for fast
@@ -39,12 +44,15 @@ type SkipListNode struct {
 //   - Level: The current highest level in the skip list. This determines the
 //     height of the tallest "tower" of nodes in the structure.
 //   - Mutex: A mutex used to ensure thread-safe operations on the skip list.
+//   - size: The approximate memory footprint of the stored entries, kept up
+//     to date on every insert so that SizeInBytes does not walk the list.
 type SkipList struct {
 	Head   *SkipListNode
 	Height int
 	Length int
 	Level  int
 	Mutex  *sync.Mutex
+	size   int
 }
 
 // NewSkipList creates a new skip list with the specified height and initializes
@@ -66,9 +74,20 @@ func NewSkipList(height int) *SkipList {
 		Length: 0,
 		Level:  1,
 		Mutex:  &sync.Mutex{},
+		size:   skipListHeadSize,
 	}
 }
 
+// skipListHeadSize is the fixed overhead accounted for the head node.
+const skipListHeadSize = 40
+
+// nodeSize returns the approximate number of bytes a node occupies: its key
+// and value, the timestamp, sequence number and expiry, the deleted flag and
+// one pointer per level.
+func nodeSize(key, value string, height int) int {
+	return len(key) + len(value) + 8 + 8 + 8 + 1 + 8*height
+}
+
 // randomHeight generates a random height for a new node in the skip list.
 // The height is determined by flipping a coin until it lands on tails.
 // The maximum height is limited to the height of the skip list.
@@ -92,6 +111,12 @@ func (s *SkipList) randomHeight() int {
 // forward pointers of the nodes that precede the new node at each level.
 // Finally, the length of the skip list is incremented.
 func (s *SkipList) Insert(ts uint64, deleted bool, key, value string) {
+	s.InsertSeq(0, ts, 0, deleted, key, value)
+}
+
+// InsertSeq behaves like Insert and additionally records the sequence number
+// of the write and the expiry of the key on the node.
+func (s *SkipList) InsertSeq(seq, ts, expireAt uint64, deleted bool, key, value string) {
 	s.Mutex.Lock()
 	defer s.Mutex.Unlock()
 
@@ -107,9 +132,12 @@ func (s *SkipList) Insert(ts uint64, deleted bool, key, value string) {
 
 	if current.Next[0] != nil && current.Next[0].Key == key {
 		node := current.Next[0]
+		s.size += len(value) - len(node.Value)
 		node.Value = value
 		node.Deleted = deleted
 		node.Ts = ts
+		node.Seq = seq
+		node.ExpireAt = expireAt
 		return
 	}
 
@@ -122,11 +150,13 @@ func (s *SkipList) Insert(ts uint64, deleted bool, key, value string) {
 	}
 
 	newNode := &SkipListNode{
-		Key:     key,
-		Value:   value,
-		Deleted: deleted,
-		Ts:      ts,
-		Next:    make([]*SkipListNode, newHeight),
+		Key:      key,
+		Value:    value,
+		Deleted:  deleted,
+		Ts:       ts,
+		Seq:      seq,
+		ExpireAt: expireAt,
+		Next:     make([]*SkipListNode, newHeight),
 	}
 
 	for i := 0; i < newHeight; i++ {
@@ -135,6 +165,7 @@ func (s *SkipList) Insert(ts uint64, deleted bool, key, value string) {
 	}
 
 	s.Length++
+	s.size += nodeSize(key, value, newHeight)
 }
 
 // Get retrieves the value associated with a given key in the skip list.
@@ -164,6 +195,34 @@ func (s *SkipList) Get(key string) (string, bool) {
 	return "", false
 }
 
+// Find looks up the node stored for key. Unlike Get it also reports
+// tombstones, so that a deleted key can shadow older versions stored
+// elsewhere. The returned node is a copy without forward pointers.
+func (s *SkipList) Find(key string) (SkipListNode, bool) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	current := s.Head
+	for i := s.Level - 1; i >= 0; i-- {
+		for current.Next[i] != nil && current.Next[i].Key < key {
+			current = current.Next[i]
+		}
+	}
+
+	current = current.Next[0]
+	if current != nil && current.Key == key {
+		return SkipListNode{
+			Key:      current.Key,
+			Value:    current.Value,
+			Deleted:  current.Deleted,
+			Ts:       current.Ts,
+			Seq:      current.Seq,
+			ExpireAt: current.ExpireAt,
+		}, true
+	}
+	return SkipListNode{}, false
+}
+
 // GetLength returns the current number of elements in the skip list.
 // This function is useful for monitoring the size of the skip list
 // and can be used to determine when to resize or rehash the structure.
@@ -217,6 +276,7 @@ func (s *SkipList) Clear() {
 	s.Head.Next = make([]*SkipListNode, s.Height)
 	s.Length = 0
 	s.Level = 1
+	s.size = skipListHeadSize
 }
 
 // Print prints the contents of the skip list.
@@ -238,9 +298,11 @@ func (s *SkipList) Print() {
 	}
 }
 
-// Delete removes a key-value pair from the skip list.
+// Delete removes a key-value pair from the skip list by inserting a
+// tombstone. The node is kept so that the deletion shadows older versions
+// of the key once the skip list is flushed to disk.
 func (s *SkipList) Delete(key string, ts uint64) {
-	s.Insert(ts, false, key, "(nil)")
+	s.Insert(ts, true, key, "")
 }
 
 // fun that returns a iterator for the skip list
@@ -277,9 +339,5 @@ func (s *SkipList) Unlock() {
 func (s *SkipList) SizeInBytes() int {
 	s.Mutex.Lock()
 	defer s.Mutex.Unlock()
-	size := 40 // Size of head node
-	for current := s.Head.Next[0]; current != nil; current = current.Next[0] {
-		size += len(current.Key) + len(current.Value) + 8 + 1 + 8*(len(current.Next))
-	}
-	return size
+	return s.size
 }
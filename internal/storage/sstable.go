@@ -1 +1,907 @@
 package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/sebzz2k2/vaultic/internal/wal"
+	"github.com/sebzz2k2/vaultic/pkg/utils"
+)
+
+/*
+An SSTable is an immutable file of sorted entries:
+
+	data block 0
+	...
+	data block N-1
+	filter block
+	meta block
+	index block
+	footer
+
+Data blocks hold the entries in key order. The value of each data block entry
+is prefixed with the entry's metadata:
+
+	1 byte flags (bit 0 deleted, bit 1 expires, bit 2 separate)
+	uvarint sequence number
+	uvarint timestamp
+	uvarint expiry in Unix milliseconds, only with the expires flag
+	<rest> bytes value
+
+Values of separateValueSize bytes or more are not kept in the block. They are
+written between the data blocks, split into chunks of valueChunkSize bytes,
+and the entry has the separate flag and holds their place instead of <rest>:
+
+	uvarint offset of the value in the file
+	uvarint value size
+
+At that offset the value is followed by a CRC of each of its chunks, so part
+of a value can be read and verified without reading all of it. Tables of
+format version 1 have no separate values.
+
+The index block maps the last key of every data block to the block's handle
+(uvarint offset, uvarint size), so a point lookup reads at most one data block.
+The filter block is a Bloom filter over all keys of the table (see bloom.go)
+followed by a CRC; it is optional and only written when filters are enabled.
+The meta block holds the table properties (min/max key, entry count, sequence
+range, the level the table was written for, the log offset the table covers
+and the handle of the filter block) as key/value entries. All other blocks use the layout described in block.go and
+end with their own CRC, so corruption is detected per block.
+
+The footer has a fixed size:
+
+	8 bytes meta block offset
+	8 bytes meta block size
+	8 bytes index block offset
+	8 bytes index block size
+	4 bytes format version
+	8 bytes magic
+*/
+
+const (
+	sstableExt = ".sst"
+	tmpExt     = ".tmp"
+
+	// sstableMagic marks the end of a completely written SSTable ("VAULTIC1").
+	sstableMagic         uint64 = 0x5641554c54494331
+	sstableFormatVersion uint32 = 2
+	sstableFooterSize           = 44
+
+	defaultBlockSize = 4 * 1024
+
+	entryFlagDeleted  = 1 << 0
+	entryFlagExpires  = 1 << 1
+	entryFlagSeparate = 1 << 2
+
+	// separateValueSize is the size from which values are stored outside
+	// the data blocks, in chunks of valueChunkSize bytes.
+	separateValueSize = 16 * 1024
+	valueChunkSize    = 4 * 1024
+
+	propEntries = "entries"
+	propFilter  = "filter"
+	propLevel   = "level"
+	propLogEnd  = "log.end"
+	propMaxKey  = "max.key"
+	propMaxSeq  = "max.seq"
+	propMinKey  = "min.key"
+	propMinSeq  = "min.seq"
+)
+
+var ErrBadSSTable = errors.New("not a valid sstable")
+
+// entry is a single version of a key as it is stored in memtables and
+// SSTables. ExpireAt is when the key expires in Unix milliseconds, zero if
+// it does not. ref locates a value stored outside the data blocks of an
+// SSTable; it is only set while Value has not been read.
+type entry struct {
+	Key      string
+	Value    string
+	Deleted  bool
+	Seq      uint64
+	Ts       uint64
+	ExpireAt uint64
+	ref      valueRef
+}
+
+// valueRef is the place of a separate value in an SSTable. A zero size
+// means the entry has no unread separate value.
+type valueRef struct {
+	table  *SSTable
+	offset uint64
+	size   uint64
+}
+
+// chunks returns the number of chunks a separate value of size bytes is
+// split into.
+func chunks(size uint64) uint64 {
+	return (size + valueChunkSize - 1) / valueChunkSize
+}
+
+// live reports whether e holds a value that has not expired by now, in Unix
+// milliseconds. An expired entry hides older versions just like a tombstone.
+func (e entry) live(now uint64) bool {
+	return !e.Deleted && (e.ExpireAt == 0 || e.ExpireAt > now)
+}
+
+type blockHandle struct {
+	offset uint64
+	size   uint64 // trailer included
+}
+
+func (h blockHandle) encode() []byte {
+	b := binary.AppendUvarint(nil, h.offset)
+	return binary.AppendUvarint(b, h.size)
+}
+
+func decodeBlockHandle(b []byte) (blockHandle, error) {
+	offset, n1 := binary.Uvarint(b)
+	if n1 <= 0 {
+		return blockHandle{}, ErrCorruption
+	}
+	size, n2 := binary.Uvarint(b[n1:])
+	if n2 <= 0 {
+		return blockHandle{}, ErrCorruption
+	}
+	return blockHandle{offset: offset, size: size}, nil
+}
+
+// encodeEntryValue encodes the metadata and value of e. With a separate
+// value, sep is its place and e.Value is left out.
+func encodeEntryValue(e entry, sep *valueRef) []byte {
+	var flags byte
+	if e.Deleted {
+		flags |= entryFlagDeleted
+	}
+	if e.ExpireAt != 0 {
+		flags |= entryFlagExpires
+	}
+	if sep != nil {
+		flags |= entryFlagSeparate
+	}
+	b := make([]byte, 0, 1+5*binary.MaxVarintLen64+len(e.Value))
+	b = append(b, flags)
+	b = binary.AppendUvarint(b, e.Seq)
+	b = binary.AppendUvarint(b, e.Ts)
+	if e.ExpireAt != 0 {
+		b = binary.AppendUvarint(b, e.ExpireAt)
+	}
+	if sep != nil {
+		b = binary.AppendUvarint(b, sep.offset)
+		return binary.AppendUvarint(b, sep.size)
+	}
+	return append(b, e.Value...)
+}
+
+// decodeEntryValue decodes an entry of a data block of t. A separate value
+// is not read; the entry's ref tells where it is.
+func decodeEntryValue(t *SSTable, key string, b []byte) (entry, error) {
+	return decodeEntry(t, key, b, true)
+}
+
+// decodeEntry decodes an entry like decodeEntryValue, leaving its value
+// empty unless withValue is set.
+func decodeEntry(t *SSTable, key string, b []byte, withValue bool) (entry, error) {
+	if len(b) < 1 {
+		return entry{}, ErrCorruption
+	}
+	seq, n1 := binary.Uvarint(b[1:])
+	if n1 <= 0 {
+		return entry{}, ErrCorruption
+	}
+	ts, n2 := binary.Uvarint(b[1+n1:])
+	if n2 <= 0 {
+		return entry{}, ErrCorruption
+	}
+	pos := 1 + n1 + n2
+	var expireAt uint64
+	if b[0]&entryFlagExpires != 0 {
+		var n3 int
+		expireAt, n3 = binary.Uvarint(b[pos:])
+		if n3 <= 0 {
+			return entry{}, ErrCorruption
+		}
+		pos += n3
+	}
+	e := entry{
+		Key:      key,
+		Deleted:  b[0]&entryFlagDeleted != 0,
+		Seq:      seq,
+		Ts:       ts,
+		ExpireAt: expireAt,
+	}
+	switch {
+	case b[0]&entryFlagSeparate != 0:
+		offset, n4 := binary.Uvarint(b[pos:])
+		if n4 <= 0 {
+			return entry{}, ErrCorruption
+		}
+		size, n5 := binary.Uvarint(b[pos+n4:])
+		if n5 <= 0 || size == 0 {
+			return entry{}, ErrCorruption
+		}
+		if withValue {
+			e.ref = valueRef{table: t, offset: offset, size: size}
+		}
+	case withValue:
+		e.Value = string(b[pos:])
+	}
+	return e, nil
+}
+
+// SSTable is an open, immutable table file.
+//
+// Fields:
+//   - FileNum: The number the file is named after; higher numbers are newer.
+//   - Path: The location of the file on disk.
+//   - Size: The size of the file in bytes.
+//   - Level: The level of the LSM tree the table belongs to.
+//   - MinKey, MaxKey: The smallest and largest key stored in the table.
+//   - Entries: The number of entries, tombstones included.
+//   - MinSeq, MaxSeq: The range of sequence numbers of the stored entries.
+//   - LogEnd: The offset in the write-ahead log up to which every record is
+//     contained in this table or an older one.
+//   - filter: The Bloom filter over the keys of the table, nil if the table
+//     was written without one or the filter block is damaged.
+//   - refs: The number of versions the table is part of.
+//   - obsolete: Set once a compaction has replaced the table; the file is
+//     removed when the last version using it goes away.
+type SSTable struct {
+	FileNum uint64
+	Path    string
+	Size    int64
+	Level   int
+	MinKey  string
+	MaxKey  string
+	Entries uint64
+	MinSeq  uint64
+	MaxSeq  uint64
+	LogEnd  int64
+
+	file   *os.File
+	index  []indexEntry
+	filter bloomFilter
+	stats  filterCounters
+
+	refs     atomic.Int32
+	obsolete atomic.Bool
+}
+
+type indexEntry struct {
+	lastKey string
+	handle  blockHandle
+}
+
+func sstablePath(dir string, num uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d%s", num, sstableExt))
+}
+
+func parseSSTableName(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, sstableExt) {
+		return 0, false
+	}
+	num, err := strconv.ParseUint(strings.TrimSuffix(name, sstableExt), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return num, true
+}
+
+// sstableWriter builds a table from entries added in strictly increasing key
+// order. The file is written under a temporary name and only renamed into
+// place by finish, once synced, so a crash never leaves a partially written
+// table behind.
+type sstableWriter struct {
+	path       string
+	file       *os.File
+	buf        *bufio.Writer
+	offset     uint64
+	blockSize  int
+	bitsPerKey int
+	level      int
+
+	data      *blockBuilder
+	index     *blockBuilder
+	keyHashes []uint32
+
+	minKey  string
+	maxKey  string
+	entries uint64
+	minSeq  uint64
+	maxSeq  uint64
+	logEnd  int64
+}
+
+// newSSTableWriter creates a writer for a table of the given level at path.
+// A bitsPerKey of zero disables the Bloom filter.
+func newSSTableWriter(path string, level, blockSize, bitsPerKey int) (*sstableWriter, error) {
+	if blockSize <= 0 {
+		blockSize = defaultBlockSize
+	}
+	file, err := os.OpenFile(path+tmpExt, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &sstableWriter{
+		path:       path,
+		file:       file,
+		buf:        bufio.NewWriter(file),
+		blockSize:  blockSize,
+		bitsPerKey: bitsPerKey,
+		level:      level,
+		data:       newBlockBuilder(blockRestartInterval),
+		index:      newBlockBuilder(1),
+	}, nil
+}
+
+func (w *sstableWriter) add(e entry) error {
+	if w.entries == 0 {
+		w.minKey = e.Key
+		w.minSeq = e.Seq
+	}
+	w.maxKey = e.Key
+	w.minSeq = min(w.minSeq, e.Seq)
+	w.maxSeq = max(w.maxSeq, e.Seq)
+	w.entries++
+	if w.bitsPerKey > 0 {
+		w.keyHashes = append(w.keyHashes, bloomHash(e.Key))
+	}
+
+	var sep *valueRef
+	if !e.Deleted && len(e.Value) >= separateValueSize {
+		ref, err := w.writeValue(e.Value)
+		if err != nil {
+			return err
+		}
+		sep = &ref
+	}
+	w.data.add([]byte(e.Key), encodeEntryValue(e, sep))
+	if w.data.estimatedSize() >= w.blockSize {
+		return w.flushDataBlock()
+	}
+	return nil
+}
+
+// writeValue writes a separate value and the CRCs of its chunks at the
+// current end of the file and returns its place.
+func (w *sstableWriter) writeValue(value string) (valueRef, error) {
+	ref := valueRef{offset: w.offset, size: uint64(len(value))}
+	if _, err := w.buf.WriteString(value); err != nil {
+		return valueRef{}, err
+	}
+	crcs := make([]byte, 0, 4*chunks(ref.size))
+	for i := 0; i < len(value); i += valueChunkSize {
+		crcs = binary.BigEndian.AppendUint32(crcs, utils.Crc32(value[i:min(i+valueChunkSize, len(value))]))
+	}
+	if _, err := w.buf.Write(crcs); err != nil {
+		return valueRef{}, err
+	}
+	w.offset += ref.size + uint64(len(crcs))
+	return ref, nil
+}
+
+func (w *sstableWriter) writeBlock(b *blockBuilder) (blockHandle, error) {
+	raw := b.finish()
+	handle := blockHandle{offset: w.offset, size: uint64(len(raw))}
+	if _, err := w.buf.Write(raw); err != nil {
+		return blockHandle{}, err
+	}
+	w.offset += uint64(len(raw))
+	b.reset()
+	return handle, nil
+}
+
+func (w *sstableWriter) flushDataBlock() error {
+	if w.data.empty() {
+		return nil
+	}
+	lastKey := append([]byte(nil), w.data.lastKey...)
+	handle, err := w.writeBlock(w.data)
+	if err != nil {
+		return err
+	}
+	w.index.add(lastKey, handle.encode())
+	return nil
+}
+
+// finish seals the table and moves it into place.
+func (w *sstableWriter) finish() (*SSTable, error) {
+	if err := w.seal(); err != nil {
+		return nil, err
+	}
+	return w.commit()
+}
+
+// seal writes the remaining blocks and the footer and syncs the file, which
+// keeps its temporary name until commit is called.
+func (w *sstableWriter) seal() error {
+	if err := w.flushDataBlock(); err != nil {
+		return err
+	}
+
+	var filterHandle blockHandle
+	if w.bitsPerKey > 0 {
+		raw := newBloomFilter(w.keyHashes, w.bitsPerKey)
+		raw = binary.BigEndian.AppendUint32(raw, utils.Crc32(string(raw)))
+		filterHandle = blockHandle{offset: w.offset, size: uint64(len(raw))}
+		if _, err := w.buf.Write(raw); err != nil {
+			return err
+		}
+		w.offset += uint64(len(raw))
+	}
+
+	meta := newBlockBuilder(1)
+	meta.add([]byte(propEntries), binary.AppendUvarint(nil, w.entries))
+	if filterHandle.size > 0 {
+		meta.add([]byte(propFilter), filterHandle.encode())
+	}
+	meta.add([]byte(propLevel), binary.AppendUvarint(nil, uint64(w.level)))
+	meta.add([]byte(propLogEnd), binary.AppendUvarint(nil, uint64(w.logEnd)))
+	meta.add([]byte(propMaxKey), []byte(w.maxKey))
+	meta.add([]byte(propMaxSeq), binary.AppendUvarint(nil, w.maxSeq))
+	meta.add([]byte(propMinKey), []byte(w.minKey))
+	meta.add([]byte(propMinSeq), binary.AppendUvarint(nil, w.minSeq))
+	metaHandle, err := w.writeBlock(meta)
+	if err != nil {
+		return err
+	}
+	indexHandle, err := w.writeBlock(w.index)
+	if err != nil {
+		return err
+	}
+
+	footer := make([]byte, 0, sstableFooterSize)
+	footer = binary.BigEndian.AppendUint64(footer, metaHandle.offset)
+	footer = binary.BigEndian.AppendUint64(footer, metaHandle.size)
+	footer = binary.BigEndian.AppendUint64(footer, indexHandle.offset)
+	footer = binary.BigEndian.AppendUint64(footer, indexHandle.size)
+	footer = binary.BigEndian.AppendUint32(footer, sstableFormatVersion)
+	footer = binary.BigEndian.AppendUint64(footer, sstableMagic)
+	if _, err := w.buf.Write(footer); err != nil {
+		return err
+	}
+
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+// commit renames a sealed table into place and opens it.
+func (w *sstableWriter) commit() (*SSTable, error) {
+	if err := os.Rename(w.path+tmpExt, w.path); err != nil {
+		return nil, err
+	}
+	// The manifest is about to name the table, and flushed log segments
+	// are deleted once it does, so the rename must survive a power loss.
+	if err := wal.SyncDir(filepath.Dir(w.path)); err != nil {
+		return nil, err
+	}
+	return openSSTable(w.path)
+}
+
+// abort discards a table that has not been finished.
+func (w *sstableWriter) abort() {
+	w.file.Close()
+	os.Remove(w.path + tmpExt)
+}
+
+// writeSSTable streams the entries of a frozen memtable, which a skip list
+// already keeps in key order, into a new level 0 SSTable.
+func writeSSTable(path string, blockSize, bitsPerKey int, mem *memTable) (*SSTable, error) {
+	w, err := newSSTableWriter(path, 0, blockSize, bitsPerKey)
+	if err != nil {
+		return nil, err
+	}
+	w.logEnd = mem.logEnd
+
+	// A frozen memtable is never written to again, and it was handed over
+	// under se.mu, so it is walked without its lock. Readers falling through
+	// to it do not wait for the flush.
+	for node := mem.list.Head.Next[0]; node != nil; node = node.Next[0] {
+		err = w.add(entry{Key: node.Key, Value: node.Value, Deleted: node.Deleted, Seq: node.Seq, Ts: node.Ts, ExpireAt: node.ExpireAt})
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		w.abort()
+		return nil, err
+	}
+
+	t, err := w.finish()
+	if err != nil {
+		w.abort()
+		return nil, err
+	}
+	return t, nil
+}
+
+// openSSTable opens a table and loads its footer, index and meta blocks.
+func openSSTable(path string) (*SSTable, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := loadSSTable(path, file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func loadSSTable(path string, file *os.File) (*SSTable, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < sstableFooterSize {
+		return nil, fmt.Errorf("%w: %s is too short", ErrBadSSTable, path)
+	}
+
+	footer := make([]byte, sstableFooterSize)
+	if _, err := file.ReadAt(footer, info.Size()-sstableFooterSize); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint64(footer[36:44]) != sstableMagic {
+		return nil, fmt.Errorf("%w: %s has a bad magic number", ErrBadSSTable, path)
+	}
+	if v := binary.BigEndian.Uint32(footer[32:36]); v < 1 || v > sstableFormatVersion {
+		return nil, fmt.Errorf("%w: %s has unsupported format version %d", ErrBadSSTable, path, v)
+	}
+
+	num, _ := parseSSTableName(filepath.Base(path))
+	t := &SSTable{
+		FileNum: num,
+		Path:    path,
+		Size:    info.Size(),
+		file:    file,
+	}
+
+	metaHandle := blockHandle{
+		offset: binary.BigEndian.Uint64(footer[0:8]),
+		size:   binary.BigEndian.Uint64(footer[8:16]),
+	}
+	indexHandle := blockHandle{
+		offset: binary.BigEndian.Uint64(footer[16:24]),
+		size:   binary.BigEndian.Uint64(footer[24:32]),
+	}
+
+	meta, err := t.readBlock(metaHandle)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.loadProperties(meta); err != nil {
+		return nil, err
+	}
+
+	index, err := t.readBlock(indexHandle)
+	if err != nil {
+		return nil, err
+	}
+	it := index.iterator()
+	for it.next() {
+		handle, err := decodeBlockHandle(it.value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad handle in index block of %s", ErrCorruption, path)
+		}
+		t.index = append(t.index, indexEntry{lastKey: string(it.key), handle: handle})
+	}
+	if it.err != nil {
+		return nil, fmt.Errorf("%w: bad index block in %s", it.err, path)
+	}
+	return t, nil
+}
+
+func (t *SSTable) loadProperties(meta *block) error {
+	it := meta.iterator()
+	for it.next() {
+		switch string(it.key) {
+		case propMinKey:
+			t.MinKey = string(it.value)
+		case propMaxKey:
+			t.MaxKey = string(it.value)
+		case propEntries:
+			t.Entries, _ = binary.Uvarint(it.value)
+		case propMinSeq:
+			t.MinSeq, _ = binary.Uvarint(it.value)
+		case propMaxSeq:
+			t.MaxSeq, _ = binary.Uvarint(it.value)
+		case propLogEnd:
+			logEnd, _ := binary.Uvarint(it.value)
+			t.LogEnd = int64(logEnd)
+		case propLevel:
+			level, _ := binary.Uvarint(it.value)
+			if level >= numLevels {
+				return fmt.Errorf("%w: bad level %d in %s", ErrCorruption, level, t.Path)
+			}
+			t.Level = int(level)
+		case propFilter:
+			handle, err := decodeBlockHandle(it.value)
+			if err != nil {
+				return fmt.Errorf("%w: bad filter handle in %s", err, t.Path)
+			}
+			t.loadFilter(handle)
+		}
+	}
+	if it.err != nil {
+		return fmt.Errorf("%w: bad meta block in %s", it.err, t.Path)
+	}
+	return nil
+}
+
+// loadFilter reads the Bloom filter into memory. A damaged filter only costs
+// the table its shortcut for negative lookups, so it is dropped rather than
+// failing the whole table.
+func (t *SSTable) loadFilter(h blockHandle) {
+	if h.size <= blockTrailerSize || h.offset+h.size > uint64(t.Size) {
+		log.Warn().Str("table", t.Path).Msg("Ignoring out of bounds bloom filter")
+		return
+	}
+	raw := make([]byte, h.size)
+	if _, err := t.file.ReadAt(raw, int64(h.offset)); err != nil {
+		log.Warn().Err(err).Str("table", t.Path).Msg("Failed to read bloom filter")
+		return
+	}
+	body := raw[:len(raw)-blockTrailerSize]
+	if utils.Crc32(string(body)) != binary.BigEndian.Uint32(raw[len(raw)-blockTrailerSize:]) {
+		log.Warn().Str("table", t.Path).Uint64("offset", h.offset).Msg("Ignoring bloom filter with checksum mismatch")
+		return
+	}
+	t.filter = bloomFilter(body)
+}
+
+// FilterStats reports how the Bloom filter of the table answered lookups.
+func (t *SSTable) FilterStats() FilterStats {
+	return t.stats.snapshot()
+}
+
+// readBlock reads and verifies the block behind handle.
+func (t *SSTable) readBlock(h blockHandle) (*block, error) {
+	if h.offset+h.size > uint64(t.Size) {
+		return nil, fmt.Errorf("%w: block at offset %d of %s is out of bounds", ErrCorruption, h.offset, t.Path)
+	}
+	raw := make([]byte, h.size)
+	if _, err := t.file.ReadAt(raw, int64(h.offset)); err != nil {
+		return nil, err
+	}
+	b, err := decodeBlock(raw, h.offset)
+	if err != nil {
+		return nil, fmt.Errorf("%w in %s", err, t.Path)
+	}
+	return b, nil
+}
+
+// Get looks key up, reading at most one data block, and the value if it is
+// stored separately. The Bloom filter is consulted first so that most
+// lookups for absent keys read no data block at all. Tombstones are returned
+// as found entries with Deleted set.
+func (t *SSTable) Get(key string) (entry, bool, error) {
+	e, found, err := t.find(key)
+	if err != nil || !found {
+		return e, found, err
+	}
+	return e, true, e.load()
+}
+
+// find looks key up like Get, but leaves a separate value unread.
+func (t *SSTable) find(key string) (entry, bool, error) {
+	if key < t.MinKey || key > t.MaxKey {
+		return entry{}, false, nil
+	}
+	i := sort.Search(len(t.index), func(i int) bool { return t.index[i].lastKey >= key })
+	if i == len(t.index) {
+		return entry{}, false, nil
+	}
+	if t.filter != nil {
+		t.stats.checks.Add(1)
+		if !t.filter.mayContain(key) {
+			t.stats.negatives.Add(1)
+			return entry{}, false, nil
+		}
+	}
+
+	e, found, err := t.get(key, t.index[i].handle)
+	if err == nil && !found && t.filter != nil {
+		t.stats.falsePositives.Add(1)
+	}
+	return e, found, err
+}
+
+func (t *SSTable) get(key string, h blockHandle) (entry, bool, error) {
+	b, err := t.readBlock(h)
+	if err != nil {
+		return entry{}, false, err
+	}
+	it := b.iterator()
+	if !it.seek([]byte(key)) {
+		if it.err != nil {
+			return entry{}, false, fmt.Errorf("%w: bad entry in block at offset %d of %s", it.err, h.offset, t.Path)
+		}
+		return entry{}, false, nil
+	}
+	if string(it.key) != key {
+		return entry{}, false, nil
+	}
+	e, err := decodeEntryValue(t, key, it.value)
+	if err != nil {
+		return entry{}, false, fmt.Errorf("%w: bad entry in block at offset %d of %s", err, h.offset, t.Path)
+	}
+	return e, true, nil
+}
+
+// readValue reads the bytes from..to of the separate value at ref, which
+// must lie within the value. Only the chunks holding them are read and
+// verified.
+func (t *SSTable) readValue(ref valueRef, from, to uint64) (string, error) {
+	if ref.offset+ref.size+4*chunks(ref.size) > uint64(t.Size) {
+		return "", fmt.Errorf("%w: value at offset %d of %s is out of bounds", ErrCorruption, ref.offset, t.Path)
+	}
+	if from >= to {
+		return "", nil
+	}
+	first, last := from/valueChunkSize, (to-1)/valueChunkSize
+	start, end := first*valueChunkSize, min((last+1)*valueChunkSize, ref.size)
+	data := make([]byte, end-start)
+	if _, err := t.file.ReadAt(data, int64(ref.offset+start)); err != nil {
+		return "", err
+	}
+	crcs := make([]byte, 4*(last-first+1))
+	if _, err := t.file.ReadAt(crcs, int64(ref.offset+ref.size+4*first)); err != nil {
+		return "", err
+	}
+	for i := range last - first + 1 {
+		chunk := data[i*valueChunkSize : min((i+1)*valueChunkSize, uint64(len(data)))]
+		if utils.Crc32(string(chunk)) != binary.BigEndian.Uint32(crcs[4*i:]) {
+			return "", fmt.Errorf("%w: checksum mismatch in value at offset %d of %s", ErrCorruption, ref.offset, t.Path)
+		}
+	}
+	return string(data[from-start : to-start]), nil
+}
+
+// load reads the separate value of e, if it has one that is still unread.
+func (e *entry) load() error {
+	if e.ref.size == 0 {
+		return nil
+	}
+	value, err := e.ref.table.readValue(e.ref, 0, e.ref.size)
+	if err != nil {
+		return err
+	}
+	e.Value, e.ref = value, valueRef{}
+	return nil
+}
+
+// valueRange returns the bytes from..to of the value of e, which must lie
+// within it, reading no more of a separate value than needed.
+func (e entry) valueRange(from, to int) (string, error) {
+	if e.ref.size == 0 {
+		return e.Value[from:to], nil
+	}
+	return e.ref.table.readValue(e.ref, uint64(from), uint64(to))
+}
+
+// valueSize returns the size of the value of e, whether read or not.
+func (e entry) valueSize() int {
+	if e.ref.size == 0 {
+		return len(e.Value)
+	}
+	return int(e.ref.size)
+}
+
+// Close releases the file handle of the table.
+func (t *SSTable) Close() error {
+	return t.file.Close()
+}
+
+// tableIterator walks the entries of a table in key order, one data block at
+// a time.
+type tableIterator struct {
+	t     *SSTable
+	block int
+	it    *blockIterator
+	// start is the key the first block read is searched for; sought is set
+	// while the block iterator already sits on the next entry.
+	start  string
+	sought bool
+	// keysOnly leaves the values of the entries empty, sparing their copy.
+	keysOnly bool
+	cur      entry
+	lastErr  error
+}
+
+func (t *SSTable) iterator() *tableIterator {
+	return t.iteratorFrom("")
+}
+
+// iteratorFrom returns an iterator over the entries of t with a key >= start.
+// Blocks before the one holding start are not read.
+func (t *SSTable) iteratorFrom(start string) *tableIterator {
+	i := sort.Search(len(t.index), func(i int) bool { return t.index[i].lastKey >= start })
+	return &tableIterator{t: t, block: i - 1, start: start}
+}
+
+func (ti *tableIterator) next() bool {
+	for ti.lastErr == nil {
+		if ti.it != nil && (ti.sought || ti.it.next()) {
+			ti.sought = false
+			ti.cur, ti.lastErr = decodeEntry(ti.t, string(ti.it.key), ti.it.value, !ti.keysOnly)
+			if ti.lastErr == nil {
+				ti.lastErr = ti.cur.load()
+			}
+			return ti.lastErr == nil
+		}
+		if ti.it != nil && ti.it.err != nil {
+			ti.lastErr = fmt.Errorf("%w: bad entry in block at offset %d of %s", ti.it.err, ti.t.index[ti.block].handle.offset, ti.t.Path)
+			return false
+		}
+		ti.block++
+		if ti.block >= len(ti.t.index) {
+			return false
+		}
+		b, err := ti.t.readBlock(ti.t.index[ti.block].handle)
+		if err != nil {
+			ti.lastErr = err
+			return false
+		}
+		ti.it = b.iterator()
+		if ti.start != "" {
+			ti.sought = ti.it.seek([]byte(ti.start))
+			ti.start = ""
+		}
+	}
+	return false
+}
+
+func (ti *tableIterator) entry() entry {
+	return ti.cur
+}
+
+func (ti *tableIterator) err() error {
+	return ti.lastErr
+}
+
+// loadSSTables opens every table in dir, oldest first.
+func loadSSTables(dir string) ([]*SSTable, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	tables := []*SSTable{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if _, ok := parseSSTableName(e.Name()); !ok {
+			continue
+		}
+		t, err := openSSTable(filepath.Join(dir, e.Name()))
+		if err != nil {
+			for _, t := range tables {
+				t.Close()
+			}
+			return nil, err
+		}
+		tables = append(tables, t)
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].FileNum < tables[j].FileNum })
+	return tables, nil
+}
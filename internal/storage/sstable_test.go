@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestSSTable(t *testing.T, n int) *SSTable {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	w, err := newSSTableWriter(path, 1, 256, 10)
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		e := entry{Key: fmt.Sprintf("key-%04d", i), Value: fmt.Sprintf("value-%d", i), Seq: uint64(i + 1), Ts: 42}
+		if i%10 == 0 {
+			e.Value, e.Deleted = "", true
+		}
+		if err := w.add(e); err != nil {
+			t.Fatalf("failed to add entry: %v", err)
+		}
+	}
+	table, err := w.finish()
+	if err != nil {
+		t.Fatalf("failed to finish table: %v", err)
+	}
+	t.Cleanup(func() { table.Close() })
+	return table
+}
+
+func TestSSTableRoundTrip(t *testing.T) {
+	table := writeTestSSTable(t, 500)
+
+	if table.Entries != 500 || table.MinKey != "key-0000" || table.MaxKey != "key-0499" {
+		t.Fatalf("unexpected properties: %+v", table)
+	}
+	if table.MinSeq != 1 || table.MaxSeq != 500 {
+		t.Fatalf("unexpected sequence range: %d-%d", table.MinSeq, table.MaxSeq)
+	}
+	if len(table.index) < 2 {
+		t.Fatalf("expected several data blocks, got %d", len(table.index))
+	}
+
+	for i := 0; i < 500; i++ {
+		e, found, err := table.Get(fmt.Sprintf("key-%04d", i))
+		if err != nil || !found {
+			t.Fatalf("key-%04d: found=%v err=%v", i, found, err)
+		}
+		if i%10 == 0 {
+			if !e.Deleted {
+				t.Fatalf("key-%04d: expected a tombstone", i)
+			}
+			continue
+		}
+		if e.Value != fmt.Sprintf("value-%d", i) || e.Seq != uint64(i+1) || e.Ts != 42 {
+			t.Fatalf("key-%04d: unexpected entry %+v", i, e)
+		}
+	}
+
+	for _, key := range []string{"a", "key-0000a", "key-1000", "z"} {
+		if _, found, err := table.Get(key); found || err != nil {
+			t.Fatalf("%s: expected a miss, got found=%v err=%v", key, found, err)
+		}
+	}
+
+	count := 0
+	it := table.iterator()
+	for it.next() {
+		if want := fmt.Sprintf("key-%04d", count); it.entry().Key != want {
+			t.Fatalf("iterator returned %s, want %s", it.entry().Key, want)
+		}
+		count++
+	}
+	if it.err() != nil || count != 500 {
+		t.Fatalf("iterator stopped after %d entries: %v", count, it.err())
+	}
+
+	for _, tt := range []struct {
+		start string
+		first int
+	}{{"", 0}, {"key-0123", 123}, {"key-0123a", 124}, {"key-0499", 499}, {"key-1", 500}} {
+		it := table.iteratorFrom(tt.start)
+		i := tt.first
+		for ; it.next(); i++ {
+			if want := fmt.Sprintf("key-%04d", i); it.entry().Key != want {
+				t.Fatalf("iterator from %q returned %s, want %s", tt.start, it.entry().Key, want)
+			}
+		}
+		if it.err() != nil || i != 500 {
+			t.Fatalf("iterator from %q stopped at %d: %v", tt.start, i, it.err())
+		}
+	}
+}
+
+func TestSSTableCorruptionIsPinnedToBlock(t *testing.T) {
+	table := writeTestSSTable(t, 500)
+
+	bad := table.index[1]
+	data, err := os.ReadFile(table.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[bad.handle.offset+2] ^= 0xff
+	if err := os.WriteFile(table.Path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openSSTable(table.Path)
+	if err != nil {
+		t.Fatalf("corrupt data block should not prevent opening the table: %v", err)
+	}
+	defer reopened.Close()
+
+	if _, _, err := reopened.Get(bad.lastKey); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("expected corruption error for key in damaged block, got %v", err)
+	}
+	if _, found, err := reopened.Get(table.index[0].lastKey); err != nil || !found {
+		t.Fatalf("key in intact block should still be readable: found=%v err=%v", found, err)
+	}
+}
+
+func TestSSTableSeparateValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	w, err := newSSTableWriter(path, 1, 256, 10)
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+	big := strings.Repeat("0123456789", 10*valueChunkSize)
+	for i, e := range []entry{
+		{Key: "a", Value: "small", Seq: 1},
+		{Key: "b", Value: big, Seq: 2},
+		{Key: "c", Value: big[:separateValueSize], Seq: 3, ExpireAt: 99},
+	} {
+		if err := w.add(e); err != nil {
+			t.Fatalf("failed to add entry %d: %v", i, err)
+		}
+	}
+	table, err := w.finish()
+	if err != nil {
+		t.Fatalf("failed to finish table: %v", err)
+	}
+	defer table.Close()
+
+	e, found, err := table.find("b")
+	if err != nil || !found || e.Value != "" || e.valueSize() != len(big) {
+		t.Fatalf("expected an unread separate value: %+v %v %v", e, found, err)
+	}
+	for _, r := range [][2]int{{0, 1}, {valueChunkSize - 3, valueChunkSize + 3}, {len(big) - 5, len(big)}, {7, 7}} {
+		part, err := e.valueRange(r[0], r[1])
+		if err != nil || part != big[r[0]:r[1]] {
+			t.Fatalf("range %v: got %q %v", r, part, err)
+		}
+	}
+
+	want := map[string]string{"a": "small", "b": big, "c": big[:separateValueSize]}
+	it := table.iterator()
+	for it.next() {
+		if e := it.entry(); e.Value != want[e.Key] {
+			t.Fatalf("iterator returned a wrong value for %s", e.Key)
+		}
+	}
+	if err := it.err(); err != nil {
+		t.Fatal(err)
+	}
+	if e, _, err := table.Get("c"); err != nil || e.Value != want["c"] || e.ExpireAt != 99 {
+		t.Fatalf("unexpected entry for c: %v", err)
+	}
+}
+
+func TestSSTableBloomFilterSkipsMisses(t *testing.T) {
+	table := writeTestSSTable(t, 500)
+	if table.filter == nil {
+		t.Fatal("expected the table to carry a bloom filter")
+	}
+
+	for i := 0; i < 1000; i++ {
+		if _, found, err := table.Get(fmt.Sprintf("key-%04da", i%499)); found || err != nil {
+			t.Fatalf("unexpected hit: found=%v err=%v", found, err)
+		}
+	}
+	stats := table.FilterStats()
+	if stats.Checks != 1000 || stats.Negatives+stats.FalsePositives != 1000 {
+		t.Fatalf("unexpected filter counters: %+v", stats)
+	}
+	// 10 bits per key gives a false positive rate of about 1%.
+	if rate := stats.FalsePositiveRate(); rate > 0.05 {
+		t.Fatalf("false positive rate too high: %.3f", rate)
+	}
+}
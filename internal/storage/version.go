@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/sebzz2k2/vaultic/internal/wal"
+)
+
+// numLevels is the number of levels SSTables are organised in. Level 0 holds
+// flushed memtables whose key ranges may overlap; every deeper level holds
+// tables with disjoint key ranges sorted by key.
+const numLevels = 7
+
+// version is an immutable snapshot of the live SSTables of every level. Each
+// flush or compaction installs a new version. Readers hold a reference on
+// the version they read from, so the tables of that version stay open until
+// the last reader is done, even if a compaction has replaced them meanwhile.
+type version struct {
+	levels [numLevels][]*SSTable
+	refs   atomic.Int32
+}
+
+func newVersion(levels [numLevels][]*SSTable) *version {
+	v := &version{levels: levels}
+	for _, tables := range levels {
+		for _, t := range tables {
+			t.refs.Add(1)
+		}
+	}
+	v.refs.Store(1)
+	return v
+}
+
+func (v *version) ref() {
+	v.refs.Add(1)
+}
+
+// unref drops a reference. Once a version is no longer referenced it
+// releases its tables, which closes every table no other version uses.
+func (v *version) unref() {
+	if v.refs.Add(-1) != 0 {
+		return
+	}
+	for _, tables := range v.levels {
+		for _, t := range tables {
+			t.unref()
+		}
+	}
+}
+
+// unref drops a version's reference on the table. The last reference closes
+// the file and, if a compaction has made the table obsolete, removes it.
+func (t *SSTable) unref() {
+	if t.refs.Add(-1) != 0 {
+		return
+	}
+	t.Close()
+	if t.obsolete.Load() {
+		if err := os.Remove(t.Path); err != nil {
+			log.Error().Err(err).Str("table", t.Path).Msg("Failed to remove obsolete sstable")
+			return
+		}
+		if err := wal.SyncDir(filepath.Dir(t.Path)); err != nil {
+			log.Error().Err(err).Str("table", t.Path).Msg("Failed to sync data directory")
+		}
+	}
+}
+
+// find looks key up level by level. Level 0 tables may overlap and are
+// searched newest first. A table merged by size-tiered compaction can span
+// the sequence numbers of tables left out of the merge, so the search of
+// level 0 only stops once no remaining table can hold a newer version than
+// the one found. Every other level holds at most one table whose range
+// contains key. A separate value is left unread.
+func (v *version) find(key string) (entry, bool, error) {
+	var newest entry
+	found := false
+	l0 := v.levels[0]
+	for i := len(l0) - 1; i >= 0; i-- {
+		if found && l0[i].MaxSeq < newest.Seq {
+			break
+		}
+		e, ok, err := l0[i].find(key)
+		if err != nil {
+			return entry{}, false, err
+		}
+		if ok && (!found || e.Seq > newest.Seq) {
+			newest, found = e, true
+		}
+	}
+	if found {
+		return newest, true, nil
+	}
+	for level := 1; level < numLevels; level++ {
+		t := findTable(v.levels[level], key)
+		if t == nil {
+			continue
+		}
+		e, found, err := t.find(key)
+		if err != nil || found {
+			return e, found, err
+		}
+	}
+	return entry{}, false, nil
+}
+
+// findTable returns the table of a sorted, non-overlapping level whose key
+// range contains key.
+func findTable(tables []*SSTable, key string) *SSTable {
+	i := sort.Search(len(tables), func(i int) bool { return tables[i].MaxKey >= key })
+	if i < len(tables) && tables[i].MinKey <= key {
+		return tables[i]
+	}
+	return nil
+}
+
+// overlapping returns the tables of a level whose key range intersects
+// [minKey, maxKey].
+func overlapping(tables []*SSTable, minKey, maxKey string) []*SSTable {
+	var out []*SSTable
+	for _, t := range tables {
+		if t.MaxKey >= minKey && t.MinKey <= maxKey {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func levelSize(tables []*SSTable) int64 {
+	size := int64(0)
+	for _, t := range tables {
+		size += t.Size
+	}
+	return size
+}
+
+func (v *version) tables() []*SSTable {
+	var all []*SSTable
+	for _, tables := range v.levels {
+		all = append(all, tables...)
+	}
+	return all
+}
+
+// apply returns the levels of v with the removed tables taken out and the
+// added tables put in place.
+func (v *version) apply(removed []*SSTable, added []*SSTable) [numLevels][]*SSTable {
+	drop := map[*SSTable]bool{}
+	for _, t := range removed {
+		drop[t] = true
+	}
+
+	var levels [numLevels][]*SSTable
+	for level, tables := range v.levels {
+		for _, t := range tables {
+			if !drop[t] {
+				levels[level] = append(levels[level], t)
+			}
+		}
+	}
+	for _, t := range added {
+		levels[t.Level] = append(levels[t.Level], t)
+	}
+	sortLevels(&levels)
+	return levels
+}
+
+// levelOrder orders level 0 tables by age, oldest first: by their newest
+// entry and, for tables holding the same entries, by file number.
+func levelOrder(a, b *SSTable) bool {
+	if a.MaxSeq != b.MaxSeq {
+		return a.MaxSeq < b.MaxSeq
+	}
+	return a.FileNum < b.FileNum
+}
+
+// sortLevels orders level 0 by age, oldest first, and every other level by
+// key.
+func sortLevels(levels *[numLevels][]*SSTable) {
+	sort.Slice(levels[0], func(i, j int) bool { return levelOrder(levels[0][i], levels[0][j]) })
+	for level := 1; level < numLevels; level++ {
+		tables := levels[level]
+		sort.Slice(tables, func(i, j int) bool { return tables[i].MinKey < tables[j].MinKey })
+	}
+}
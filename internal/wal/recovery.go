@@ -0,0 +1,285 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrCorrupt is returned by Replay under RecoverFail when a damaged record
+// is followed by intact ones.
+var ErrCorrupt = errors.New("write-ahead log is corrupt")
+
+// RecoveryPolicy decides what Replay does with a damaged record that is
+// followed by intact records. A damaged record with nothing intact behind
+// it is what a crash in the middle of an append leaves; it is cut off under
+// every policy.
+type RecoveryPolicy string
+
+const (
+	// RecoverTruncate keeps the records before the damaged one and drops
+	// it together with everything after it.
+	RecoverTruncate RecoveryPolicy = "truncate"
+	// RecoverSkip drops only the damaged bytes and carries on with the next
+	// intact record.
+	RecoverSkip RecoveryPolicy = "skip"
+	// RecoverFail makes Replay return ErrCorrupt.
+	RecoverFail RecoveryPolicy = "fail"
+)
+
+// ParseRecoveryPolicy returns the policy named s. Empty means RecoverTruncate.
+func ParseRecoveryPolicy(s string) (RecoveryPolicy, error) {
+	switch p := RecoveryPolicy(s); p {
+	case "":
+		return RecoverTruncate, nil
+	case RecoverTruncate, RecoverSkip, RecoverFail:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown WAL recovery policy %q", s)
+	}
+}
+
+// RecoveryReport sums up a replay of the log.
+//
+// Fields:
+//   - Records: The number of records passed to the replay callback.
+//   - DroppedRecords: The number of records lost: each damaged stretch
+//     counts as one, plus every intact record truncated behind it.
+//   - DroppedBytes: The number of bytes of the dropped records.
+//   - TornTails: The number of segments that ended in a torn record.
+type RecoveryReport struct {
+	Records        int64
+	DroppedRecords int64
+	DroppedBytes   int64
+	TornTails      int
+}
+
+// Replay decodes every record from position from onwards and passes it to
+// fn together with the position just past it. Segments are streamed record
+// by record. Where a record is damaged, the rest of its segment is searched
+// for the next intact record, and policy decides what happens to it. Torn
+// tails and, under RecoverTruncate, the dropped records are removed from
+// disk so that later appends and replays do not run into them again.
+func (w *WAL) Replay(from int64, policy RecoveryPolicy, fn func(entry map[string]interface{}, end int64) error) (RecoveryReport, error) {
+	var report RecoveryReport
+
+	w.mu.Lock()
+	segments := append([]int64{}, w.segments...)
+	w.mu.Unlock()
+
+	for i, base := range segments {
+		if i+1 < len(segments) && segments[i+1] <= from {
+			continue
+		}
+		stop, err := w.replaySegment(base, max(from-base, 0), policy, &report, fn)
+		if err != nil {
+			return report, err
+		}
+		if stop {
+			if err := w.dropAfter(base, &report); err != nil {
+				return report, err
+			}
+			break
+		}
+	}
+	return report, nil
+}
+
+// replaySegment replays the segment at base from offset on. It reports stop
+// when the rest of the log has to be dropped.
+func (w *WAL) replaySegment(base, offset int64, policy RecoveryPolicy, report *RecoveryReport, fn func(entry map[string]interface{}, end int64) error) (bool, error) {
+	path := segmentPath(w.dir, base)
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	size := info.Size()
+
+	r := bufio.NewReader(io.NewSectionReader(f, offset, size-offset))
+	for offset < size {
+		rec, err := readRecord(r, size-offset)
+		var entry map[string]interface{}
+		if err == nil {
+			entry, err = w.DecodeWAL(rec)
+		}
+		if err == nil {
+			offset += int64(len(rec))
+			report.Records++
+			if err := fn(entry, base+offset); err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		// The rest of a damaged segment is small enough, at most about one
+		// segment, to be searched in memory.
+		rest := make([]byte, size-offset)
+		if _, err := f.ReadAt(rest, offset); err != nil {
+			return false, err
+		}
+		next := w.resync(rest)
+		if next < 0 {
+			log.Warn().Err(err).
+				Int64("position", base+offset).
+				Int64("dropped_bytes", size-offset).
+				Msg("Cutting off torn record at the end of WAL segment")
+			report.TornTails++
+			report.DroppedRecords++
+			report.DroppedBytes += size - offset
+			return false, w.truncateSegment(base, offset)
+		}
+
+		switch policy {
+		case RecoverFail:
+			return false, fmt.Errorf("%w: damaged record at position %d: %v", ErrCorrupt, base+offset, err)
+		case RecoverSkip:
+			log.Warn().Err(err).
+				Int64("position", base+offset).
+				Int("dropped_bytes", next).
+				Msg("Skipping damaged WAL record")
+			report.DroppedRecords++
+			report.DroppedBytes += int64(next)
+			offset += int64(next)
+			r.Reset(io.NewSectionReader(f, offset, size-offset))
+		default:
+			dropped := 1 + w.countRecords(rest[next:])
+			log.Warn().Err(err).
+				Int64("position", base+offset).
+				Int64("dropped_records", dropped).
+				Int64("dropped_bytes", size-offset).
+				Msg("Truncating WAL at damaged record")
+			report.DroppedRecords += dropped
+			report.DroppedBytes += size - offset
+			return true, w.truncateSegment(base, offset)
+		}
+	}
+	return false, nil
+}
+
+// readRecord reads the next record from r, which holds remaining more bytes
+// of the segment. A record running past the end of the segment is damaged.
+func readRecord(r *bufio.Reader, remaining int64) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("short record header: %w", err)
+	}
+	length := int64(binary.BigEndian.Uint32(header[:]))
+	if length < HeaderSize || length > remaining {
+		return nil, fmt.Errorf("invalid record length %d", length)
+	}
+	rec := make([]byte, length)
+	copy(rec, header[:])
+	if _, err := io.ReadFull(r, rec[4:]); err != nil {
+		return nil, fmt.Errorf("short record: %w", err)
+	}
+	return rec, nil
+}
+
+// recordAt returns the length of the intact record at the start of data, or
+// zero if there is none.
+func (w *WAL) recordAt(data []byte) int {
+	if len(data) < HeaderSize {
+		return 0
+	}
+	length := int(binary.BigEndian.Uint32(data[:4]))
+	if length < HeaderSize || length > len(data) {
+		return 0
+	}
+	if _, err := w.DecodeWAL(data[:length]); err != nil {
+		return 0
+	}
+	return length
+}
+
+// resync returns the offset of the first intact record in data after its
+// first byte, or -1 if there is none.
+func (w *WAL) resync(data []byte) int {
+	for i := 1; i+HeaderSize <= len(data); i++ {
+		if w.recordAt(data[i:]) > 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// countRecords counts the intact records in data.
+func (w *WAL) countRecords(data []byte) int64 {
+	n := int64(0)
+	for offset := 0; offset < len(data); {
+		if length := w.recordAt(data[offset:]); length > 0 {
+			n++
+			offset += length
+			continue
+		}
+		next := w.resync(data[offset:])
+		if next < 0 {
+			break
+		}
+		offset += next
+	}
+	return n
+}
+
+// truncateSegment cuts the segment at base off at offset and syncs it.
+func (w *WAL) truncateSegment(base, offset int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	f, err := os.OpenFile(segmentPath(w.dir, base), os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(offset); err != nil {
+		return fmt.Errorf("failed to truncate WAL segment: %w", err)
+	}
+	if base == w.segments[len(w.segments)-1] {
+		w.size = offset
+	}
+	return f.Sync()
+}
+
+// dropAfter deletes every segment after the one at base, counting their
+// records as dropped. The open segment stays, since appends go to it; when
+// the log was just opened, it is still empty.
+func (w *WAL) dropAfter(base int64, report *RecoveryReport) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	kept := w.segments[:0]
+	open := w.segments[len(w.segments)-1]
+	for _, seg := range w.segments {
+		if seg <= base || seg == open {
+			kept = append(kept, seg)
+			continue
+		}
+		path := segmentPath(w.dir, seg)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		dropped := w.countRecords(data)
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		log.Warn().
+			Str("segment", path).
+			Int64("dropped_records", dropped).
+			Int("dropped_bytes", len(data)).
+			Msg("Removed WAL segment behind damaged record")
+		report.DroppedRecords += dropped
+		report.DroppedBytes += int64(len(data))
+	}
+	w.segments = kept
+	return nil
+}
@@ -0,0 +1,179 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// writeSegment writes n records as the first segment of a log in dir and
+// returns the records.
+func writeSegment(t *testing.T, dir string, n int) [][]byte {
+	t.Helper()
+	w := &WAL{}
+	var recs [][]byte
+	var data []byte
+	for i := 0; i < n; i++ {
+		rec, _ := w.EncodeWAL(1, false, 1, false, fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+		recs = append(recs, rec)
+		data = append(data, rec...)
+	}
+	if err := os.WriteFile(segmentPath(dir, 0), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return recs
+}
+
+func replayPolicy(w *WAL, policy RecoveryPolicy) ([]string, RecoveryReport, error) {
+	var keys []string
+	report, err := w.Replay(0, policy, func(entry map[string]interface{}, end int64) error {
+		keys = append(keys, entry["key"].(string))
+		return nil
+	})
+	return keys, report, err
+}
+
+func TestReplayCutsOffTornTail(t *testing.T) {
+	dir := t.TempDir()
+	recs := writeSegment(t, dir, 5)
+	intact := int64(0)
+	for _, rec := range recs {
+		intact += int64(len(rec))
+	}
+
+	// A crash half way through appending a sixth record.
+	f, err := os.OpenFile(segmentPath(dir, 0), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(recs[0][:len(recs[0])/2])
+	f.Close()
+
+	w, err := NewWAL(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	keys, report, err := replayPolicy(w, RecoverFail)
+	if err != nil {
+		t.Fatalf("torn tail stopped recovery: %v", err)
+	}
+	want := RecoveryReport{Records: 5, DroppedRecords: 1, DroppedBytes: int64(len(recs[0]) / 2), TornTails: 1}
+	if len(keys) != 5 || report != want {
+		t.Fatalf("got %v %+v, want 5 records and %+v", keys, report, want)
+	}
+	if info, _ := os.Stat(segmentPath(dir, 0)); info.Size() != intact {
+		t.Fatalf("torn record was not cut off: segment holds %d bytes, want %d", info.Size(), intact)
+	}
+
+	rec, _ := w.EncodeWAL(1, false, 1, false, "after-crash", "value")
+	if _, err := w.Append(rec); err != nil {
+		t.Fatal(err)
+	}
+	keys, report, err = replayPolicy(w, RecoverFail)
+	if err != nil || len(keys) != 6 || keys[5] != "after-crash" || report.DroppedRecords != 0 {
+		t.Fatalf("unexpected replay after recovery: %v %+v %v", keys, report, err)
+	}
+}
+
+func TestReplayDamagedRecord(t *testing.T) {
+	for _, tt := range []struct {
+		policy  RecoveryPolicy
+		keys    int
+		dropped int64
+	}{
+		{RecoverTruncate, 2, 4},
+		{RecoverSkip, 5, 1},
+		{RecoverFail, 0, 0},
+	} {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			dir := t.TempDir()
+			recs := writeSegment(t, dir, 6)
+
+			// Flip a bit in the value of the third record.
+			data, _ := os.ReadFile(segmentPath(dir, 0))
+			damaged := len(recs[0]) + len(recs[1])
+			data[damaged+len(recs[2])-1] ^= 0x01
+			os.WriteFile(segmentPath(dir, 0), data, 0644)
+
+			w, err := NewWAL(dir, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+			keys, report, err := replayPolicy(w, tt.policy)
+			if tt.policy == RecoverFail {
+				if !errors.Is(err, ErrCorrupt) {
+					t.Fatalf("expected corruption, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != tt.keys || report.DroppedRecords != tt.dropped || report.TornTails != 0 {
+				t.Fatalf("got %v %+v, want %d records and %d dropped", keys, report, tt.keys, tt.dropped)
+			}
+			for _, key := range keys {
+				if key == "key-2" {
+					t.Fatal("damaged record was replayed")
+				}
+			}
+
+			// Truncation is permanent; a skipped record is met again.
+			_, again, err := replayPolicy(w, tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.policy == RecoverTruncate && again.DroppedRecords != 0 {
+				t.Fatalf("truncated log still reports dropped records: %+v", again)
+			}
+			if tt.policy == RecoverSkip && again != report {
+				t.Fatalf("second replay reported %+v, want %+v", again, report)
+			}
+		})
+	}
+}
+
+func TestReplayBatch(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWAL(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	ops := []BatchOp{
+		{Key: "a", Value: "1"},
+		{Key: "b", Deleted: true},
+		{Key: "c", Value: "3", ExpireAt: 1234},
+	}
+	rec, _ := w.EncodeBatch(1, 1, 7, ops)
+	if _, err := w.Append(rec); err != nil {
+		t.Fatal(err)
+	}
+	// A batch without its commit marker is damaged even with a valid CRC.
+	unmarked, _ := encodeRecord(1, encodeFlags(false, false, false, false, true), 1, "", string(rec[HeaderSize:len(rec)-4]), 0)
+	if _, err := w.DecodeWAL(unmarked); err == nil {
+		t.Fatal("batch without commit marker was decoded")
+	}
+	// A torn second batch is dropped as a whole.
+	if _, err := w.Append(rec[:len(rec)-1]); err != nil {
+		t.Fatal(err)
+	}
+
+	var got [][]BatchOp
+	report, err := w.Replay(0, RecoverFail, func(entry map[string]interface{}, end int64) error {
+		if seq := entry["firstSeq"].(uint64); seq != 7 {
+			t.Errorf("first sequence number %d, want 7", seq)
+		}
+		got = append(got, entry["ops"].([]BatchOp))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || fmt.Sprint(got[0]) != fmt.Sprint(ops) || report.DroppedRecords != 1 {
+		t.Fatalf("got %+v %+v, want one batch of %+v", got, report, ops)
+	}
+}
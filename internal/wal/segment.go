@@ -0,0 +1,324 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/sebzz2k2/vaultic/pkg/utils"
+)
+
+const (
+	segmentPrefix = "wal-"
+	segmentExt    = ".log"
+
+	// DefaultSegmentSize is the size a segment may reach before the log
+	// rolls over to a new one.
+	DefaultSegmentSize = 64 * 1024 * 1024
+)
+
+// WAL is the write-ahead log. It is split into segment files, each named
+// after the log position of its first byte, so a position is a plain byte
+// offset into the whole log no matter which segment holds it. Records are
+// appended to the newest segment; older segments are deleted once every
+// record in them is contained in an SSTable.
+//
+// Fields:
+//   - dir: The directory holding the segments.
+//   - maxSegmentSize: The size at which Append rolls to a new segment.
+//   - segments: The base positions of all segments, oldest first; the last
+//     one is open for appending.
+//   - file: The open newest segment.
+//   - size: The number of bytes in the open segment.
+//   - torn: Set when a failed write may have left part of a record behind
+//     size; the segment is cut back to size before the next append.
+//   - syncMu: Held by the writer syncing the log; the others queue behind it.
+//   - synced: The position up to which the log is known to be on disk.
+//   - syncs: The number of syncs SyncTo performed.
+//   - syncFile: Syncs the open segment; tests replace it to slow syncs down.
+//   - writeFile: Writes to the open segment; tests replace it to make
+//     writes fail half way.
+type WAL struct {
+	mu             sync.Mutex
+	dir            string
+	maxSegmentSize int64
+	segments       []int64
+	file           *os.File
+	size           int64
+	torn           bool
+
+	syncMu sync.Mutex
+	synced atomic.Int64
+	syncs  atomic.Uint64
+
+	syncFile  func(*os.File) error
+	writeFile func(*os.File, []byte) (int, error)
+}
+
+func segmentPath(dir string, base int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%020d%s", segmentPrefix, base, segmentExt))
+}
+
+func parseSegmentName(name string) (int64, bool) {
+	if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentExt) {
+		return 0, false
+	}
+	base, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentExt), 10, 64)
+	if err != nil || base < 0 {
+		return 0, false
+	}
+	return base, true
+}
+
+// NewWAL opens the log in dir. Appends never go behind data written before
+// the log was opened, since that may end in a torn record: unless the newest
+// segment is empty, a new segment is started after it. A log written as the
+// single file of older versions becomes the first segment.
+func NewWAL(dir string, maxSegmentSize int64) (*WAL, error) {
+	if maxSegmentSize <= 0 {
+		maxSegmentSize = DefaultSegmentSize
+	}
+	w := &WAL{
+		dir:            dir,
+		maxSegmentSize: maxSegmentSize,
+		syncFile:       (*os.File).Sync,
+		writeFile:      (*os.File).Write,
+	}
+
+	segments, err := w.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	legacy := filepath.Join(dir, utils.FILENAME)
+	if _, err := os.Stat(legacy); err == nil && len(segments) == 0 {
+		if err := os.Rename(legacy, segmentPath(dir, 0)); err != nil {
+			return nil, fmt.Errorf("failed to migrate %s: %w", legacy, err)
+		}
+		if err := SyncDir(dir); err != nil {
+			return nil, err
+		}
+		log.Info().Str("file", legacy).Msg("Migrated write-ahead log to segments")
+		segments = []int64{0}
+	}
+	w.segments = segments
+
+	if len(segments) > 0 {
+		last := segments[len(segments)-1]
+		info, err := os.Stat(segmentPath(dir, last))
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() == 0 {
+			return w, w.openSegment(last)
+		}
+		return w, w.openSegment(last + info.Size())
+	}
+	return w, w.openSegment(0)
+}
+
+func (w *WAL) listSegments() ([]int64, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []int64
+	for _, e := range entries {
+		if base, ok := parseSegmentName(e.Name()); ok && !e.IsDir() {
+			segments = append(segments, base)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// openSegment makes the segment starting at base the one appended to. The
+// caller must hold mu or own w exclusively.
+func (w *WAL) openSegment(base int64) error {
+	path := segmentPath(w.dir, base)
+	_, statErr := os.Stat(path)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if os.IsNotExist(statErr) {
+		// Syncing the records of a new segment does not make the segment
+		// itself survive a power loss; syncing the directory does.
+		if err := SyncDir(w.dir); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if w.file != nil {
+		// Only the open segment is ever synced by SyncTo, so a segment must
+		// be on disk before it is left behind.
+		if err := w.file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+		w.advanceSynced(w.end())
+		w.file.Close()
+	}
+	if n := len(w.segments); n == 0 || w.segments[n-1] != base {
+		w.segments = append(w.segments, base)
+	}
+	w.file, w.size, w.torn = file, size, false
+	w.advanceSynced(base + size)
+	return nil
+}
+
+func (w *WAL) advanceSynced(pos int64) {
+	for {
+		cur := w.synced.Load()
+		if cur >= pos || w.synced.CompareAndSwap(cur, pos) {
+			return
+		}
+	}
+}
+
+func (w *WAL) end() int64 {
+	return w.segments[len(w.segments)-1] + w.size
+}
+
+// Append writes an encoded record and returns the log position just past
+// it. The log rolls to a new segment first if the open one is full. A
+// record that could only be written in part is cut off again, so that the
+// records appended after it are not stuck behind a torn one.
+func (w *WAL) Append(rec []byte) (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.torn {
+		if err := w.file.Truncate(w.size); err != nil {
+			return 0, fmt.Errorf("failed to cut off torn record: %w", err)
+		}
+		w.torn = false
+	}
+	if w.size > 0 && w.size+int64(len(rec)) > w.maxSegmentSize {
+		if err := w.openSegment(w.end()); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := w.writeFile(w.file, rec); err != nil {
+		w.torn = true
+		if terr := w.file.Truncate(w.size); terr == nil {
+			w.torn = false
+		}
+		return 0, err
+	}
+	w.size += int64(len(rec))
+	return w.end(), nil
+}
+
+// Rotate starts a new segment at the current end of the log, unless the
+// open segment is still empty, and returns the position it starts at.
+func (w *WAL) Rotate() (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.size == 0 {
+		return w.end(), nil
+	}
+	end := w.end()
+	return end, w.openSegment(end)
+}
+
+// Purge deletes every segment that ends at or before pos, the position up
+// to which all records are safely in SSTables. The open segment is kept.
+func (w *WAL) Purge(pos int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	removed := false
+	for len(w.segments) > 1 && w.segments[1] <= pos {
+		path := segmentPath(w.dir, w.segments[0])
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		log.Debug().Str("segment", path).Msg("Removed flushed WAL segment")
+		w.segments = w.segments[1:]
+		removed = true
+	}
+	if removed {
+		return SyncDir(w.dir)
+	}
+	return nil
+}
+
+// SyncDir makes the creation, renaming and removal of files in dir durable.
+// The storage engine uses it for its SSTables and manifest as well.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// SyncTo returns once every record up to pos is on disk. Concurrent callers
+// form a group commit: while one of them, the leader, syncs the log, the
+// others wait for it, and the next leader's sync covers all of them at once.
+func (w *WAL) SyncTo(pos int64) error {
+	if w.synced.Load() >= pos {
+		return nil
+	}
+
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	if w.synced.Load() >= pos {
+		return nil // a previous leader's sync covered pos
+	}
+
+	w.mu.Lock()
+	file, end := w.file, w.end()
+	w.mu.Unlock()
+
+	w.syncs.Add(1)
+	if err := w.syncFile(file); err != nil {
+		// A segment closed meanwhile was synced by openSegment.
+		if !errors.Is(err, os.ErrClosed) || w.synced.Load() < pos {
+			return err
+		}
+	}
+	w.advanceSynced(end)
+	return nil
+}
+
+// Syncs returns the number of times the log was synced on behalf of
+// writers.
+func (w *WAL) Syncs() uint64 {
+	return w.syncs.Load()
+}
+
+// Sync flushes everything appended so far to disk.
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	end := w.end()
+	w.mu.Unlock()
+	return w.SyncTo(end)
+}
+
+// Close syncs and closes the open segment.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
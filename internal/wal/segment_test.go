@@ -0,0 +1,187 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sebzz2k2/vaultic/pkg/utils"
+)
+
+func replayKeys(t *testing.T, w *WAL, from int64) ([]string, []int64) {
+	t.Helper()
+	var keys []string
+	var ends []int64
+	_, err := w.Replay(from, RecoverFail, func(entry map[string]interface{}, end int64) error {
+		keys = append(keys, entry["key"].(string))
+		ends = append(ends, end)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys, ends
+}
+
+func TestWALRollsAndPurgesSegments(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWAL(dir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ends []int64
+	for i := 0; i < 20; i++ {
+		rec, _ := w.EncodeWAL(1, false, 1, false, fmt.Sprintf("key-%02d", i), "value")
+		end, err := w.Append(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ends = append(ends, end)
+	}
+	if len(w.segments) < 3 {
+		t.Fatalf("expected the log to roll over, got %d segments", len(w.segments))
+	}
+
+	keys, replayEnds := replayKeys(t, w, ends[9])
+	if len(keys) != 10 || keys[0] != "key-10" || replayEnds[9] != ends[19] {
+		t.Fatalf("unexpected replay from the middle: %v %v", keys, replayEnds)
+	}
+
+	if err := w.Purge(ends[9]); err != nil {
+		t.Fatal(err)
+	}
+	for _, base := range w.segments[1:] {
+		if base <= ends[9] {
+			t.Fatalf("segment at %d should have been purged", base)
+		}
+	}
+	if keys, _ := replayKeys(t, w, ends[9]); len(keys) != 10 {
+		t.Fatalf("purge lost unflushed records: %v", keys)
+	}
+	w.Close()
+
+	// Reopening starts a new segment behind the old ones.
+	w, err = NewWAL(dir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	rec, _ := w.EncodeWAL(1, false, 1, false, "after-reopen", "value")
+	if _, err := w.Append(rec); err != nil {
+		t.Fatal(err)
+	}
+	keys, _ = replayKeys(t, w, ends[9])
+	if len(keys) != 11 || keys[10] != "after-reopen" {
+		t.Fatalf("unexpected replay after reopen: %v", keys)
+	}
+}
+
+func TestWALMigratesLegacyLog(t *testing.T) {
+	dir := t.TempDir()
+	w := &WAL{}
+	var data []byte
+	for i := 0; i < 3; i++ {
+		rec, _ := w.EncodeWAL(1, false, 1, false, fmt.Sprintf("key-%d", i), "value")
+		data = append(data, rec...)
+	}
+	if err := os.WriteFile(filepath.Join(dir, utils.FILENAME), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewWAL(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, err := os.Stat(filepath.Join(dir, utils.FILENAME)); !os.IsNotExist(err) {
+		t.Fatal("legacy log was not migrated")
+	}
+	keys, ends := replayKeys(t, w, 0)
+	if len(keys) != 3 || ends[2] != int64(len(data)) {
+		t.Fatalf("unexpected replay of migrated log: %v %v", keys, ends)
+	}
+}
+
+func TestWALGroupCommitSharesSyncs(t *testing.T) {
+	w, err := NewWAL(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.syncFile = func(f *os.File) error {
+		time.Sleep(2 * time.Millisecond)
+		return f.Sync()
+	}
+
+	const writers, perWriter = 16, 10
+	var appendMu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWriter; j++ {
+				rec, _ := w.EncodeWAL(1, false, 1, false, fmt.Sprintf("key-%d-%d", i, j), "value")
+				appendMu.Lock()
+				end, err := w.Append(rec)
+				appendMu.Unlock()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if err := w.SyncTo(end); err != nil {
+					t.Error(err)
+					return
+				}
+				if w.synced.Load() < end {
+					t.Errorf("SyncTo(%d) returned before the position was synced", end)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if syncs := w.Syncs(); syncs == 0 || syncs >= writers*perWriter/2 {
+		t.Fatalf("%d writes took %d syncs; expected writers to share them", writers*perWriter, syncs)
+	}
+}
+
+func TestWALCutsOffFailedAppend(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWAL(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	appendKey := func(key string) (int64, error) {
+		rec, _ := w.EncodeWAL(1, false, 1, false, key, "value")
+		return w.Append(rec)
+	}
+
+	if _, err := appendKey("before"); err != nil {
+		t.Fatal(err)
+	}
+	// A disk that fills up half way through a record.
+	w.writeFile = func(f *os.File, b []byte) (int, error) {
+		n, _ := f.Write(b[:len(b)/2])
+		return n, fmt.Errorf("no space left on device")
+	}
+	if _, err := appendKey("failed"); err == nil {
+		t.Fatal("failed write was acknowledged")
+	}
+	w.writeFile = (*os.File).Write
+	end, err := appendKey("after")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, ends := replayKeys(t, w, 0)
+	if fmt.Sprint(keys) != "[before after]" || ends[1] != end {
+		t.Fatalf("replayed %v ending at %v, want [before after] ending at %d", keys, ends, end)
+	}
+}
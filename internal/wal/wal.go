@@ -7,17 +7,13 @@ import (
 	"github.com/sebzz2k2/vaultic/pkg/utils"
 )
 
-type WAL struct {
-}
-
-func NewWAL() *WAL {
-	return &WAL{}
-}
-
 /*
 0th bit deleted 0 or 1
-1st bit version 0 or 1
-3rd - 7th bit reserved 0 for now
+1st bit compressed 0 or 1
+2nd bit checkpoint 0 or 1
+3rd bit expires 0 or 1
+4th bit batch 0 or 1
+5th - 7th bit reserved 0 for now
 */
 func encodeFlags(flags ...bool) byte {
 	var encoded byte
@@ -29,6 +25,13 @@ func encodeFlags(flags ...bool) byte {
 	return encoded
 }
 
+// HeaderSize is the size of a record without its key and value.
+const HeaderSize = 4 + 1 + 1 + 4 + 8 + 2 + 4
+
+// expirySize is the size of the expiry that follows the value of records
+// with the expires flag.
+const expirySize = 8
+
 /*
 4 bytes length
 1 byte version
@@ -39,13 +42,33 @@ func encodeFlags(flags ...bool) byte {
 4 bytes value length
 <key length> bytes key
 <value length> bytes value
+8 bytes expiry in Unix milliseconds, only with the expires flag
 */
 func (w *WAL) EncodeWAL(version int, deleted bool, ts uint64, checkpoint bool, key, value string) ([]byte, int) {
+	return w.EncodeExpiringWAL(version, deleted, ts, checkpoint, key, value, 0)
+}
+
+// EncodeExpiringWAL encodes a record like EncodeWAL for a key that expires
+// at expireAt, in Unix milliseconds. A zero expireAt means the key does not
+// expire and gives the same record as EncodeWAL. The CRC covers the expiry.
+func (w *WAL) EncodeExpiringWAL(version int, deleted bool, ts uint64, checkpoint bool, key, value string, expireAt uint64) ([]byte, int) {
+	return encodeRecord(version, encodeFlags(deleted, false, checkpoint, expireAt != 0), ts, key, value, expireAt)
+}
+
+// encodeRecord encodes a record with the given flags. The expires flag must
+// be set exactly when expireAt is not zero.
+func encodeRecord(version int, flags byte, ts uint64, key, value string, expireAt uint64) ([]byte, int) {
 	keyLen := uint16(len(key))     // 2 bytes for key length
 	valueLen := uint32(len(value)) // 4 bytes for value length
+	expires := expireAt != 0
 
 	// Calculate total length (including the 4-byte length field)
 	totalLength := 4 + 1 + 1 + 4 + 8 + 2 + 4 + len(key) + len(value) // 4 bytes for length field
+	var expiry []byte
+	if expires {
+		expiry = binary.BigEndian.AppendUint64(nil, expireAt)
+		totalLength += expirySize
+	}
 
 	encoded := make([]byte, 0, totalLength) // Preallocate memory
 
@@ -53,12 +76,11 @@ func (w *WAL) EncodeWAL(version int, deleted bool, ts uint64, checkpoint bool, k
 	encoded = append(encoded,
 		byte(totalLength>>24), byte(totalLength>>16), byte(totalLength>>8), byte(totalLength))
 
-	flags := encodeFlags(deleted, false, checkpoint)
 	encoded = append(encoded, byte(version))
 	encoded = append(encoded, flags)
 
 	// Store keyValCRC (4 bytes)
-	keyValCRC := utils.Crc32(key + value)
+	keyValCRC := utils.Crc32(key + value + string(expiry))
 	encoded = append(encoded, byte(keyValCRC>>24), byte(keyValCRC>>16), byte(keyValCRC>>8), byte(keyValCRC))
 
 	// Store timestamp (8 bytes)
@@ -76,6 +98,7 @@ func (w *WAL) EncodeWAL(version int, deleted bool, ts uint64, checkpoint bool, k
 	// Append key and value
 	encoded = append(encoded, key...)
 	encoded = append(encoded, value...)
+	encoded = append(encoded, expiry...)
 
 	return encoded, totalLength
 }
@@ -89,11 +112,13 @@ func decodeFlags(encoded byte) map[string]interface{} {
 		"deleted":    flags[0],
 		"compressed": flags[1],
 		"checkpoint": flags[2],
-		"reserved":   flags[3:],
+		"expires":    flags[3],
+		"batch":      flags[4],
+		"reserved":   flags[5:],
 	}
 }
 func (w *WAL) DecodeWAL(encoded []byte) (map[string]interface{}, error) {
-	if len(encoded) < 4 {
+	if len(encoded) < HeaderSize {
 		return nil, errors.New("Insufficient data")
 	}
 
@@ -111,7 +136,16 @@ func (w *WAL) DecodeWAL(encoded []byte) (map[string]interface{}, error) {
 	keyLen := binary.BigEndian.Uint16(encoded[18:20])
 	valueLen := binary.BigEndian.Uint32(encoded[20:24])
 
-	if int(24+uint32(keyLen)+valueLen) != len(encoded) {
+	end := 24 + uint64(keyLen) + uint64(valueLen)
+	var expiry string
+	var expireAt uint64
+	if decodedFlags["expires"].(bool) {
+		if end+expirySize != uint64(len(encoded)) {
+			return nil, errors.New("Mismatched key/value lengths")
+		}
+		expiry = string(encoded[end:])
+		expireAt = binary.BigEndian.Uint64(encoded[end:])
+	} else if end != uint64(len(encoded)) {
 		return nil, errors.New("Mismatched key/value lengths")
 	}
 
@@ -119,11 +153,11 @@ func (w *WAL) DecodeWAL(encoded []byte) (map[string]interface{}, error) {
 	value := string(encoded[24+uint32(keyLen) : 24+uint32(keyLen)+valueLen])
 
 	// Verify CRC
-	computedCRC := utils.Crc32(key + value)
+	computedCRC := utils.Crc32(key + value + expiry)
 	if computedCRC != keyValCRC {
 		return nil, errors.New("CRC check failed")
 	}
-	return map[string]interface{}{
+	decoded := map[string]interface{}{
 		"totalLength": totalLength,
 		"version":     version,
 		"flags":       decodedFlags,
@@ -132,5 +166,127 @@ func (w *WAL) DecodeWAL(encoded []byte) (map[string]interface{}, error) {
 		"valueLen":    valueLen,
 		"val":         value,
 		"ts":          ts,
-	}, nil
+		"expireAt":    expireAt,
+	}
+	if decodedFlags["batch"].(bool) {
+		firstSeq, ops, err := decodeBatch(value)
+		if err != nil {
+			return nil, err
+		}
+		decoded["firstSeq"] = firstSeq
+		decoded["ops"] = ops
+	}
+	return decoded, nil
+}
+
+// BatchOp is one write of a batch record.
+//
+// Fields:
+//   - Key: The key written.
+//   - Value: The value written, empty for a deletion.
+//   - Deleted: Whether the write is a tombstone.
+//   - ExpireAt: When the key expires, in Unix milliseconds. Zero means never.
+type BatchOp struct {
+	Key      string
+	Value    string
+	Deleted  bool
+	ExpireAt uint64
+}
+
+// batchCommitMarker ends the value of every batch record. A batch whose
+// value does not end with it was not written completely.
+const batchCommitMarker uint32 = 0x434d4954 // "CMIT"
+
+// batchHeaderSize is the size of the header of a batch value.
+const batchHeaderSize = 8 + 4
+
+/*
+EncodeBatch encodes ops as a single record with the batch flag, an empty
+key and the ops as its value. The ops take the sequence numbers from
+firstSeq on, in order. They share the CRC of the record, and the value ends
+with a commit marker, so a batch is replayed in full or not at all. The
+value holds:
+
+8 bytes first sequence number
+4 bytes number of ops
+and for each op:
+1 byte flags, with the deleted and expires bits of a record
+2 bytes key length
+4 bytes value length
+<key length> bytes key
+<value length> bytes value
+8 bytes expiry in Unix milliseconds, only with the expires flag
+and then:
+4 bytes commit marker
+*/
+func (w *WAL) EncodeBatch(version int, ts, firstSeq uint64, ops []BatchOp) ([]byte, int) {
+	body := binary.BigEndian.AppendUint64(nil, firstSeq)
+	body = binary.BigEndian.AppendUint32(body, uint32(len(ops)))
+	for _, op := range ops {
+		expires := op.ExpireAt != 0
+		body = append(body, encodeFlags(op.Deleted, false, false, expires))
+		body = binary.BigEndian.AppendUint16(body, uint16(len(op.Key)))
+		body = binary.BigEndian.AppendUint32(body, uint32(len(op.Value)))
+		body = append(body, op.Key...)
+		body = append(body, op.Value...)
+		if expires {
+			body = binary.BigEndian.AppendUint64(body, op.ExpireAt)
+		}
+	}
+	body = binary.BigEndian.AppendUint32(body, batchCommitMarker)
+
+	flags := encodeFlags(false, false, false, false, true)
+	return encodeRecord(version, flags, ts, "", string(body), 0)
+}
+
+// decodeBatch decodes the first sequence number and the ops of a batch
+// record from its value.
+func decodeBatch(body string) (uint64, []BatchOp, error) {
+	if len(body) < batchHeaderSize+4 {
+		return 0, nil, errors.New("Truncated batch")
+	}
+	end := len(body) - 4
+	if binary.BigEndian.Uint32([]byte(body[end:])) != batchCommitMarker {
+		return 0, nil, errors.New("Batch without commit marker")
+	}
+	firstSeq := binary.BigEndian.Uint64([]byte(body[:8]))
+	count := binary.BigEndian.Uint32([]byte(body[8:12]))
+	pos := batchHeaderSize
+	// Every op takes at least 7 bytes, which bounds the allocation.
+	if uint64(count)*7 > uint64(end-pos) {
+		return 0, nil, errors.New("Truncated batch")
+	}
+	ops := make([]BatchOp, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if end-pos < 7 {
+			return 0, nil, errors.New("Truncated batch")
+		}
+		flags := decodeFlags(body[pos])
+		keyLen := int(binary.BigEndian.Uint16([]byte(body[pos+1 : pos+3])))
+		valueLen := uint64(binary.BigEndian.Uint32([]byte(body[pos+3 : pos+7])))
+		pos += 7
+
+		size := uint64(keyLen) + valueLen
+		if flags["expires"].(bool) {
+			size += expirySize
+		}
+		if size > uint64(end-pos) {
+			return 0, nil, errors.New("Truncated batch")
+		}
+		op := BatchOp{
+			Key:     body[pos : pos+keyLen],
+			Value:   body[pos+keyLen : pos+keyLen+int(valueLen)],
+			Deleted: flags["deleted"].(bool),
+		}
+		pos += keyLen + int(valueLen)
+		if flags["expires"].(bool) {
+			op.ExpireAt = binary.BigEndian.Uint64([]byte(body[pos : pos+expirySize]))
+			pos += expirySize
+		}
+		ops = append(ops, op)
+	}
+	if pos != end {
+		return 0, nil, errors.New("Mismatched batch length")
+	}
+	return firstSeq, ops, nil
 }
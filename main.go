@@ -15,11 +15,12 @@ import (
 	"github.com/sebzz2k2/vaultic/internal/storage"
 	"github.com/sebzz2k2/vaultic/pkg/config"
 	"github.com/sebzz2k2/vaultic/pkg/logger"
+	"github.com/sebzz2k2/vaultic/pkg/utils"
 )
 
 const (
 	AppName = "Vaultic"
-	Version = "0.1.0"
+	Version = utils.Version
 
 	shutdownTimeout = 30 * time.Second
 )
@@ -99,13 +100,22 @@ func (app *Application) initLogger() error {
 func (app *Application) initServer() error {
 	log.Info().Msg("Initializing server")
 	cfg := &server.Config{
-		Address:        app.config.Server.Address,
-		Port:           app.config.Server.Port,
-		MaxConnections: app.config.Server.MaxConnections,
-		MaxMessageSize: app.config.Server.MaxMessageSize,
+		Address:         app.config.Server.Address,
+		Port:            app.config.Server.Port,
+		MaxConnections:  app.config.Server.MaxConnections,
+		MaxMessageSize:  app.config.Server.MaxMessageSize,
+		MaxBulkLength:   app.config.Server.MaxBulkLength,
+		MaxArrayLength:  app.config.Server.MaxArrayLength,
+		MaxNestingDepth: app.config.Server.MaxNestingDepth,
+	}
+	if cfg.MaxMessageSize > 0 && cfg.MaxMessageSize < cfg.MaxBulkLength {
+		log.Warn().
+			Int("max_message_size", cfg.MaxMessageSize).
+			Int("max_bulk_length", cfg.MaxBulkLength).
+			Msg("Message size limit is below the bulk length limit and caps the size of values")
 	}
 
-	svr, err := server.New(cfg, *app.engine)
+	svr, err := server.New(cfg, app.engine)
 	if err != nil {
 		return fmt.Errorf("failed to create server: %w", err)
 	}
@@ -116,7 +126,33 @@ func (app *Application) initServer() error {
 
 func (app *Application) initStorageEngine() error {
 	log.Info().Msg("Initializing storage engine")
-	engine, err := storage.NewStorageEngine()
+	engine, err := storage.NewStorageEngine(&storage.Config{
+		Dir:             app.config.DataDir,
+		WriteBufferSize: app.config.WriteBufferSize,
+		BloomBitsPerKey: app.config.BloomBitsPerKey,
+		WALSegmentSize:  app.config.WALSegmentSize,
+		Durability:      app.config.Durability,
+		WALRecovery:     app.config.WALRecovery,
+		ActiveExpiryHz:  app.config.ActiveExpiryHz,
+		Compaction: storage.CompactionConfig{
+			Strategy:    app.config.Compaction.Strategy,
+			Concurrency: app.config.Compaction.Concurrency,
+			RateLimit:   app.config.Compaction.RateLimit,
+			Leveled: storage.LeveledConfig{
+				L0Trigger:       app.config.Compaction.Leveled.L0Trigger,
+				LevelBaseSize:   app.config.Compaction.Leveled.LevelBaseSize,
+				LevelMultiplier: app.config.Compaction.Leveled.LevelMultiplier,
+				TargetFileSize:  app.config.Compaction.Leveled.TargetFileSize,
+			},
+			SizeTiered: storage.SizeTieredConfig{
+				MinThreshold:   app.config.Compaction.SizeTiered.MinThreshold,
+				MaxThreshold:   app.config.Compaction.SizeTiered.MaxThreshold,
+				BucketLow:      app.config.Compaction.SizeTiered.BucketLow,
+				BucketHigh:     app.config.Compaction.SizeTiered.BucketHigh,
+				MinSSTableSize: app.config.Compaction.SizeTiered.MinSSTableSize,
+			},
+		},
+	})
 	if err != nil {
 		return fmt.Errorf("failed to create storage engine: %w", err)
 	}
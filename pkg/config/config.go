@@ -14,15 +14,49 @@ type loggingConfig struct {
 }
 
 type serverConfig struct {
-	Address        string `yaml:"address"`
-	Port           int    `yaml:"port"`
-	MaxConnections int    `yaml:"maxConnections"`
-	MaxMessageSize int    `yaml:"maxMessageSizeBytes"` // in bytes
+	Address         string `yaml:"address"`
+	Port            int    `yaml:"port"`
+	MaxConnections  int    `yaml:"maxConnections"`
+	MaxMessageSize  int    `yaml:"maxMessageSizeBytes"` // in bytes
+	MaxBulkLength   int    `yaml:"maxBulkLengthBytes"`  // in bytes
+	MaxArrayLength  int    `yaml:"maxArrayLength"`
+	MaxNestingDepth int    `yaml:"maxNestingDepth"`
 }
+type leveledConfig struct {
+	L0Trigger       int   `yaml:"l0Trigger"`
+	LevelBaseSize   int64 `yaml:"levelBaseSizeBytes"`
+	LevelMultiplier int   `yaml:"levelMultiplier"`
+	TargetFileSize  int64 `yaml:"targetFileSizeBytes"`
+}
+
+type sizeTieredConfig struct {
+	MinThreshold   int     `yaml:"minThreshold"`
+	MaxThreshold   int     `yaml:"maxThreshold"`
+	BucketLow      float64 `yaml:"bucketLow"`
+	BucketHigh     float64 `yaml:"bucketHigh"`
+	MinSSTableSize int64   `yaml:"minSSTableSizeBytes"`
+}
+
+type compactionConfig struct {
+	Strategy    string           `yaml:"strategy"` // leveled or size-tiered
+	Concurrency int              `yaml:"concurrency"`
+	RateLimit   int              `yaml:"rateLimitBytesPerSec"` // 0 means unlimited
+	Leveled     leveledConfig    `yaml:"leveled"`
+	SizeTiered  sizeTieredConfig `yaml:"sizeTiered"`
+}
+
 type Config struct {
-	Port    int           `yaml:"port"`
-	Logging loggingConfig `yaml:"logging"`
-	Server  serverConfig  `yaml:"server"`
+	Port            int              `yaml:"port"`
+	Logging         loggingConfig    `yaml:"logging"`
+	Server          serverConfig     `yaml:"server"`
+	DataDir         string           `yaml:"data_dir"`
+	WriteBufferSize int              `yaml:"write_buffer_size_bytes"` // in bytes
+	BloomBitsPerKey int              `yaml:"bloom_bits_per_key"`
+	WALSegmentSize  int64            `yaml:"wal_segment_size_bytes"` // in bytes
+	Durability      string           `yaml:"durability"`             // always, group or everysec
+	WALRecovery     string           `yaml:"wal_recovery"`           // truncate, skip or fail
+	ActiveExpiryHz  int              `yaml:"active_expiry_hz"`       // negative disables active expiry
+	Compaction      compactionConfig `yaml:"compaction"`
 }
 
 func DefaultConfig() Config {
@@ -34,12 +68,39 @@ func DefaultConfig() Config {
 			ToConsole: true,
 		},
 		Server: serverConfig{
-			Address:        "localhost",
-			Port:           5381,
-			MaxConnections: 100,
-			MaxMessageSize: 1024 * 1024, // 1 MB
+			Address:         "localhost",
+			Port:            5381,
+			MaxConnections:  100,
+			MaxMessageSize:  1024 * 1024 * 1024, // 1 GB
+			MaxBulkLength:   512 * 1024 * 1024,  // 512 MB
+			MaxArrayLength:  1024 * 1024,
+			MaxNestingDepth: 8,
+		},
+		Port:            5381,
+		DataDir:         ".",
+		WriteBufferSize: 4 * 1024 * 1024, // 4 MB
+		BloomBitsPerKey: 10,
+		WALSegmentSize:  64 * 1024 * 1024, // 64 MB
+		Durability:      "always",
+		WALRecovery:     "truncate",
+		ActiveExpiryHz:  10,
+		Compaction: compactionConfig{
+			Strategy:    "leveled",
+			Concurrency: 1,
+			Leveled: leveledConfig{
+				L0Trigger:       4,
+				LevelBaseSize:   10 * 1024 * 1024, // 10 MB
+				LevelMultiplier: 10,
+				TargetFileSize:  2 * 1024 * 1024, // 2 MB
+			},
+			SizeTiered: sizeTieredConfig{
+				MinThreshold:   4,
+				MaxThreshold:   32,
+				BucketLow:      0.5,
+				BucketHigh:     1.5,
+				MinSSTableSize: 50 * 1024 * 1024, // 50 MB
+			},
 		},
-		Port: 5381,
 	}
 }
 
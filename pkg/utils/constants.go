@@ -1,25 +1,9 @@
 package utils
 
 const (
-	CommandGet    = "GET"
-	CommandSet    = "SET"
-	CommandDel    = "DEL"
-	CommandExists = "EXISTS"
-	CommandKeys   = "KEYS"
+	// Version is the Vaultic release, reported by HELLO.
+	Version = "0.1.0"
 
 	FILENAME  = "vaultic"
 	DELIMITER = ":"
 )
-
-var CmdArgs = map[string]int{
-	CommandSet:    2,
-	CommandGet:    1,
-	CommandDel:    1,
-	CommandExists: 1,
-	CommandKeys:   0,
-}
-
-var CmdArgsErrors = map[string]string{
-	CommandGet: "GET [val]",
-	CommandSet: "SET [val] [val]",
-}
@@ -15,8 +15,8 @@ func TestContainer(t *testing.T) {
 	vaultic := tests.NewVaulticCommands(testStack)
 
 	// Test initial state
-	require.Contains(t, vaultic.Get("a"), "(nil)")
-	require.Contains(t, vaultic.Set("a", "b"), "OK")
+	require.Contains(t, vaultic.Get("a"), "$-1")
+	require.Contains(t, vaultic.Set("a", "b"), "+OK")
 	require.Contains(t, vaultic.Get("a"), "b")
 
 	// Test persistence after restart
@@ -24,8 +24,8 @@ func TestContainer(t *testing.T) {
 	require.Contains(t, vaultic.Get("a"), "b")
 
 	// Update values
-	require.Contains(t, vaultic.Set("a", "x"), "OK")
-	require.Contains(t, vaultic.Set("b", "e"), "OK")
+	require.Contains(t, vaultic.Set("a", "x"), "+OK")
+	require.Contains(t, vaultic.Set("b", "e"), "+OK")
 	require.Contains(t, vaultic.Get("a"), "x")
 	require.Contains(t, vaultic.Get("b"), "e")
 
@@ -35,14 +35,14 @@ func TestContainer(t *testing.T) {
 	require.Contains(t, vaultic.Get("b"), "e")
 
 	// Test deletion
-	require.Contains(t, vaultic.Del("b"), "OK")
-	require.Contains(t, vaultic.Get("b"), "(nil)")
+	require.Contains(t, vaultic.Del("b"), ":1")
+	require.Contains(t, vaultic.Get("b"), "$-1")
 
 	// Test deletion persistence after restart
 	testStack.RestartContainer(t)
-	require.Contains(t, vaultic.Get("b"), "(nil)")
-	require.Contains(t, vaultic.Keys(), "a")
-	require.NotContains(t, vaultic.Keys(), "b")
-	require.Contains(t, vaultic.Exists("a"), "true")
-	require.Contains(t, vaultic.Exists("b"), "false")
+	require.Contains(t, vaultic.Get("b"), "$-1")
+	require.Contains(t, vaultic.Keys(), "$1\r\na\r\n")
+	require.NotContains(t, vaultic.Keys(), "$1\r\nb\r\n")
+	require.Contains(t, vaultic.Exists("a"), ":1")
+	require.Contains(t, vaultic.Exists("b"), ":0")
 }
@@ -155,7 +155,7 @@ func (vc *VaulticCommands) Del(key string) string {
 
 // Keys executes a KEYS command
 func (vc *VaulticCommands) Keys() string {
-	result, _ := vc.testStack.ExecCommand(`echo "KEYS" | nc -w 1 localhost 5381`)
+	result, _ := vc.testStack.ExecCommand(`echo "KEYS *" | nc -w 1 localhost 5381`)
 	return result
 }
 